@@ -0,0 +1,220 @@
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/fsutil"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Artifact is a named file kept in the store, like a firmware image.
+type Artifact struct {
+	Name     string
+	Hash     string // hex encoded sha256 of the content
+	Size     int64
+	Uploader string // fingerprint of the admin key used to upload
+	Uploaded time.Time
+}
+
+// Store is a content-addressed store of artifacts. Contents are kept once in
+// `objects/<sha256>` and an index maps names to them.
+type Store struct {
+	m     sync.Mutex
+	dir   string
+	index map[string]Artifact
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0700); err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:   dir,
+		index: make(map[string]Artifact),
+	}
+
+	data, err := ioutil.ReadFile(s.indexPath())
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.index); err != nil {
+		return nil, fmt.Errorf("Invalid artifact index %s: %s", s.indexPath(), err)
+	}
+	return s, nil
+}
+
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// Put stores the content read from r under name, replacing any artifact with
+// the same name.
+func (s *Store) Put(name, uploader string, r io.Reader) (Artifact, error) {
+	tmp, err := s.TempFile()
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return Artifact{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Artifact{}, err
+	}
+	return s.Import(name, uploader, tmp.Name())
+}
+
+// TempFile creates a file in the store which can be imported once written.
+func (s *Store) TempFile() (*os.File, error) {
+	return ioutil.TempFile(s.dir, "upload-")
+}
+
+// Import moves the file at tmpPath, created with TempFile, in the store under
+// name.
+func (s *Store) Import(name, uploader, tmpPath string) (Artifact, error) {
+	if !ValidName(name) {
+		return Artifact{}, fmt.Errorf("Invalid artifact name %q", name)
+	}
+
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		return Artifact{}, err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	file.Close()
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	a := Artifact{
+		Name:     name,
+		Hash:     hex.EncodeToString(hash.Sum(nil)),
+		Size:     size,
+		Uploader: uploader,
+		Uploaded: time.Now().UTC(),
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := os.Rename(tmpPath, s.objectPath(a.Hash)); err != nil {
+		return Artifact{}, err
+	}
+
+	s.index[name] = a
+	return a, s.save()
+}
+
+func (s *Store) Get(name string) (Artifact, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	a, exists := s.index[name]
+	return a, exists
+}
+
+// Open opens the content of an artifact for reading.
+func (s *Store) Open(name string) (*os.File, Artifact, error) {
+	a, exists := s.Get(name)
+	if !exists {
+		return nil, a, fmt.Errorf("Artifact %s not found", name)
+	}
+	file, err := os.Open(s.objectPath(a.Hash))
+	return file, a, err
+}
+
+// List returns all the artifacts sorted by name.
+func (s *Store) List() []Artifact {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	list := make([]Artifact, 0, len(s.index))
+	for _, a := range s.index {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Delete removes an artifact from the index. Its content is removed by GC
+// once no other artifact references it.
+func (s *Store) Delete(name string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, exists := s.index[name]; !exists {
+		return fmt.Errorf("Artifact %s not found", name)
+	}
+	delete(s.index, name)
+	return s.save()
+}
+
+// GC removes the contents not referenced by any artifact and leftovers of
+// interrupted uploads.
+func (s *Store) GC() (removed int, freed int64, err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	used := make(map[string]bool, len(s.index))
+	for _, a := range s.index {
+		used[a.Hash] = true
+	}
+
+	objects, err := ioutil.ReadDir(filepath.Join(s.dir, "objects"))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, object := range objects {
+		if used[object.Name()] {
+			continue
+		}
+		if err := os.Remove(s.objectPath(object.Name())); err != nil {
+			return removed, freed, err
+		}
+		removed++
+		freed += object.Size()
+	}
+
+	uploads, err := filepath.Glob(filepath.Join(s.dir, "upload-*"))
+	if err != nil {
+		return removed, freed, err
+	}
+	for _, upload := range uploads {
+		if info, err := os.Stat(upload); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+			os.Remove(upload)
+		}
+	}
+	return removed, freed, nil
+}
+
+func (s *Store) indexPath() string {
+	return filepath.Join(s.dir, "index.json")
+}
+
+func (s *Store) objectPath(hash string) string {
+	return filepath.Join(s.dir, "objects", hash)
+}
+
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(s.indexPath(), data, 0600)
+}
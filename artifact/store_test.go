@@ -0,0 +1,128 @@
+package artifact
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha256 of "firmware"
+const firmwareHash = "c3bf47ea1f4a4a605470313cacb3a44f4a461f68c6faeab07e737610cb5ac835"
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := store.Put("fw.bin", "SHA256:admin", strings.NewReader("firmware"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Name != "fw.bin" || a.Size != 8 || a.Uploader != "SHA256:admin" || a.Hash != firmwareHash {
+		t.Errorf("Put = %+v", a)
+	}
+	// the same content is stored once
+	b, err := store.Put("copy.bin", "SHA256:other", strings.NewReader("firmware"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Hash != a.Hash {
+		t.Errorf("same content with hashes %s and %s", a.Hash, b.Hash)
+	}
+	if objects, _ := ioutil.ReadDir(filepath.Join(dir, "objects")); len(objects) != 1 {
+		t.Errorf("%d objects stored, want 1", len(objects))
+	}
+
+	file, got, err := store.Open("fw.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || string(content) != "firmware" || got.Hash != a.Hash {
+		t.Errorf("Open = %q, %+v, %v", content, got, err)
+	}
+
+	// the index survives restarts
+	reopened, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := reopened.List(); len(list) != 2 || list[0].Name != "copy.bin" || list[1].Name != "fw.bin" {
+		t.Errorf("List after reopening = %+v", list)
+	}
+}
+
+func TestStoreGC(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put("a", "", strings.NewReader("shared"))
+	store.Put("b", "", strings.NewReader("shared"))
+	store.Put("c", "", strings.NewReader("alone"))
+	if _, err := store.Put("c", "", strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := store.TempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+	yesterday := time.Now().Add(-25 * time.Hour)
+	os.Chtimes(old.Name(), yesterday, yesterday)
+	recent, err := store.TempFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recent.Close()
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("a"); err == nil {
+		t.Error("deleting a twice should fail")
+	}
+	removed, freed, err := store.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the content of the replaced c isn't referenced anymore
+	if removed != 1 || freed != int64(len("alone")) {
+		t.Errorf("GC removed %d objects of %d bytes, want 1 of %d", removed, freed, len("alone"))
+	}
+	if file, _, err := store.Open("b"); err != nil {
+		t.Errorf("b lost its content: %s", err)
+	} else {
+		file.Close()
+	}
+	if _, err := os.Stat(old.Name()); !os.IsNotExist(err) {
+		t.Errorf("old upload wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(recent.Name()); err != nil {
+		t.Errorf("recent upload was removed: %s", err)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"fw-1.2.bin": true,
+		".hidden":    true,
+		"":           false,
+		".":          false,
+		"..":         false,
+		"a/b":        false,
+		`a\b`:        false,
+	} {
+		if ValidName(name) != valid {
+			t.Errorf("ValidName(%q) = %t, want %t", name, !valid, valid)
+		}
+	}
+}
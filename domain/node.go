@@ -11,4 +11,6 @@ type Node interface {
 	LastUpdate() time.Time
 	NewSession(ch Channel, pty *PtyRequest) (Session, error)
 	Dial(addr string, port uint32) (net.Conn, error)
+	// DialUDP returns a conn where each Read and Write is a datagram.
+	DialUDP(addr string, port uint32) (net.Conn, error)
 }
@@ -1,7 +1,16 @@
 package domain
 
 type Session interface {
-	Shell() error
-	Exec(cmd string) (int, error)
+	Shell() (ExitStatus, error)
+	Exec(cmd string) (ExitStatus, error)
 	SendRequest(name string, wantReply bool, payload []byte) (bool, error)
+	// Close ends the session, the command running on the node gets a SIGHUP.
+	Close() error
+}
+
+// ExitStatus describes how a command run on a node terminated.
+type ExitStatus struct {
+	Code    int    // exit code, 128 + signal number when killed by a signal
+	Signal  string // signal name without the SIG prefix (e.g. TERM), if any
+	Message string // error message sent along with the signal
 }
@@ -0,0 +1,17 @@
+module github.com/JeanSebTr/SshBrain
+
+go 1.22
+
+require (
+	github.com/Unknwon/com v0.0.0-20151008135407-28b053d5a292
+	github.com/pkg/sftp v1.13.9
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/smartystreets/goconvey v1.8.1 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/term v0.27.0 // indirect
+)
@@ -0,0 +1,242 @@
+package inventory
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateExt is the extension of the configuration templates.
+const TemplateExt = ".tmpl"
+
+// Device is the inventory entry of a device, keyed by its id.
+type Device struct {
+	Tags []string               `json:"tags"`
+	Vars map[string]interface{} `json:"vars"`
+	// Keys are the SHA256 fingerprints of the keys the device authenticates
+	// with. The id of a device isn't authenticated, so without keys any
+	// client claiming it gets its configuration: its vars must not be secret.
+	Keys []string `json:"keys,omitempty"`
+}
+
+// Inventory holds the variables used to render device configurations. A
+// device sees the global vars, overridden by the vars of its tags in order,
+// then by its own vars.
+type Inventory struct {
+	Vars    map[string]interface{}            `json:"vars"`
+	Tags    map[string]map[string]interface{} `json:"tags"`
+	Devices map[string]Device                 `json:"devices"`
+}
+
+// Data is what templates are executed with.
+type Data struct {
+	Id   string
+	Tags []string
+	Vars map[string]interface{}
+}
+
+// Store renders the templates of `templates/` with the vars of
+// `inventory.json`. Both are read again when they change so edits apply
+// without restarting the brain.
+type Store struct {
+	m         sync.Mutex
+	dir       string
+	inventory Inventory
+	modified  time.Time
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "templates"), 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) inventoryPath() string {
+	return filepath.Join(s.dir, "inventory.json")
+}
+
+// load returns the inventory, reading it again if the file changed.
+func (s *Store) load() (Inventory, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	info, err := os.Stat(s.inventoryPath())
+	if os.IsNotExist(err) {
+		s.inventory = Inventory{}
+		s.modified = time.Time{}
+		return s.inventory, nil
+	} else if err != nil {
+		return Inventory{}, err
+	}
+	if info.ModTime().Equal(s.modified) {
+		return s.inventory, nil
+	}
+
+	data, err := ioutil.ReadFile(s.inventoryPath())
+	if err != nil {
+		return Inventory{}, err
+	}
+	var inv Inventory
+	if err := json.Unmarshal(data, &inv); err != nil {
+		return Inventory{}, fmt.Errorf("Invalid inventory %s: %s", s.inventoryPath(), err)
+	}
+	devices := make(map[string]Device, len(inv.Devices))
+	for id, device := range inv.Devices {
+		devices[strings.ToUpper(id)] = device
+	}
+	inv.Devices = devices
+
+	s.inventory = inv
+	s.modified = info.ModTime()
+	return inv, nil
+}
+
+// Device returns the data templates are rendered with for a device.
+func (s *Store) Device(id string) (Data, error) {
+	inv, err := s.load()
+	if err != nil {
+		return Data{}, err
+	}
+
+	id = strings.ToUpper(id)
+	device := inv.Devices[id]
+	vars := make(map[string]interface{})
+	for k, v := range inv.Vars {
+		vars[k] = v
+	}
+	for _, tag := range device.Tags {
+		for k, v := range inv.Tags[tag] {
+			vars[k] = v
+		}
+	}
+	for k, v := range device.Vars {
+		vars[k] = v
+	}
+
+	return Data{
+		Id:   id,
+		Tags: device.Tags,
+		Vars: vars,
+	}, nil
+}
+
+// Allows tells if a client authenticated with the key of fingerprint may get
+// the configuration of the device id, which it always can when the device has
+// no Keys.
+func (s *Store) Allows(id, fingerprint string) (bool, error) {
+	inv, err := s.load()
+	if err != nil {
+		return false, err
+	}
+
+	keys := inv.Devices[strings.ToUpper(id)].Keys
+	if len(keys) == 0 {
+		return true, nil
+	}
+	for _, key := range keys {
+		if key == fingerprint {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Tags lists the tags used in the inventory.
+func (s *Store) Tags() ([]string, error) {
+	inv, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	for tag := range inv.Tags {
+		set[tag] = true
+	}
+	for _, device := range inv.Devices {
+		for _, tag := range device.Tags {
+			set[tag] = true
+		}
+	}
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// Templates lists the names of the available templates, without extension.
+func (s *Store) Templates() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "templates", "*"+TemplateExt))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = strings.TrimSuffix(filepath.Base(f), TemplateExt)
+	}
+	return names, nil
+}
+
+// Render executes the template name for a device. Using a var missing from
+// the inventory is an error rather than an empty value in the configuration.
+func (s *Store) Render(id, name string) ([]byte, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return nil, os.ErrNotExist
+	}
+	data, err := s.Device(id)
+	if err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(s.dir, "templates", name+TemplateExt)
+	tmpl, err := template.New(filepath.Base(file)).Option("missingkey=error").Funcs(template.FuncMap{
+		"join":    strings.Join,
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"hasTag":  func(tag string) bool { return hasTag(data.Tags, tag) },
+		"default": defaultValue,
+	}).ParseFiles(file)
+	if err != nil {
+		if _, statErr := os.Stat(file); os.IsNotExist(statErr) {
+			return nil, os.ErrNotExist
+		}
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultValue is used as `{{index .Vars "channel" | default 6}}`.
+func defaultValue(def, value interface{}) interface{} {
+	if value == nil || value == "" {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,186 @@
+package logstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Store keeps the logs of each device in rotating files named `<id>.log`,
+// `<id>.log.1`, ... up to `<id>.log.<keep>`.
+type Store struct {
+	m       sync.Mutex
+	dir     string
+	maxSize int64
+	keep    int
+	files   map[string]*logFile
+	subs    map[string]map[chan string]bool
+}
+
+// validId matches the ids which are safe as file names. Ids come from the
+// user name of the devices, which isn't authenticated.
+var validId = regexp.MustCompile(`^[0-9A-Z_-]+$`)
+
+type logFile struct {
+	file *os.File
+	size int64
+}
+
+func NewStore(dir string, maxSize int64, keep int) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{
+		dir:     dir,
+		maxSize: maxSize,
+		keep:    keep,
+		files:   make(map[string]*logFile),
+		subs:    make(map[string]map[chan string]bool),
+	}, nil
+}
+
+// Append adds a line to the logs of a device and sends it to its followers.
+func (s *Store) Append(id, line string) error {
+	id = strings.ToUpper(id)
+	line = strings.TrimRight(line, "\r\n")
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for sub := range s.subs[id] {
+		select {
+		case sub <- line:
+		default:
+			// slow followers miss lines rather than blocking devices
+		}
+	}
+
+	f, err := s.open(id)
+	if err != nil {
+		return err
+	}
+	n, err := fmt.Fprintln(f.file, line)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if f.size >= s.maxSize {
+		return s.rotate(id)
+	}
+	return nil
+}
+
+// Tail returns the last n lines logged by a device.
+func (s *Store) Tail(id string, n int) ([]string, error) {
+	id = strings.ToUpper(id)
+	lines := make([]string, 0, n)
+	for i := 0; i <= s.keep && len(lines) < n; i++ {
+		name, err := s.path(id, i)
+		if err != nil {
+			return nil, err
+		}
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		fileLines := make([]string, 0)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fileLines = append(fileLines, scanner.Text())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+
+		if missing := n - len(lines); len(fileLines) > missing {
+			fileLines = fileLines[len(fileLines)-missing:]
+		}
+		lines = append(fileLines, lines...)
+	}
+	return lines, nil
+}
+
+// Follow returns the lines logged by a device from now on, until cancel is
+// called.
+func (s *Store) Follow(id string) (lines <-chan string, cancel func()) {
+	id = strings.ToUpper(id)
+	sub := make(chan string, 100)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.subs[id] == nil {
+		s.subs[id] = make(map[chan string]bool)
+	}
+	s.subs[id][sub] = true
+
+	return sub, func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+		delete(s.subs[id], sub)
+	}
+}
+
+func (s *Store) path(id string, generation int) (string, error) {
+	if !validId.MatchString(id) {
+		return "", fmt.Errorf("Invalid device id %q", id)
+	}
+	name := filepath.Join(s.dir, id+".log")
+	if generation > 0 {
+		name += fmt.Sprintf(".%d", generation)
+	}
+	return name, nil
+}
+
+func (s *Store) open(id string) (*logFile, error) {
+	if f, exists := s.files[id]; exists {
+		return f, nil
+	}
+
+	name, err := s.path(id, 0)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	f := &logFile{file, info.Size()}
+	s.files[id] = f
+	return f, nil
+}
+
+func (s *Store) rotate(id string) error {
+	if f, exists := s.files[id]; exists {
+		f.file.Close()
+		delete(s.files, id)
+	}
+
+	last, err := s.path(id, s.keep)
+	if err != nil {
+		return err
+	}
+	os.Remove(last)
+	for i := s.keep - 1; i >= 0; i-- {
+		from, _ := s.path(id, i)
+		to, _ := s.path(id, i+1)
+		if err := os.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
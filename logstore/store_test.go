@@ -0,0 +1,77 @@
+package logstore
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreRotation(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each line is 6 bytes with its newline, so files rotate every 2 lines
+	for _, line := range []string{"line1", "line2", "line3", "line4", "line5", "line6", "line7\r\n"} {
+		if err := store.Append("abc", line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines, err := store.Tail("ABC", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// line1 and line2 were rotated out of the 2 kept files
+	if want := []string{"line3", "line4", "line5", "line6", "line7"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("Tail = %q, want %q", lines, want)
+	}
+	if lines, _ := store.Tail("ABC", 2); !reflect.DeepEqual(lines, []string{"line6", "line7"}) {
+		t.Errorf("Tail of 2 lines = %q", lines)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ABC.log.3")); !os.IsNotExist(err) {
+		t.Errorf("ABC.log.3 should not exist: %v", err)
+	}
+}
+
+func TestStoreFollow(t *testing.T) {
+	store, err := NewStore(t.TempDir(), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, cancel := store.Follow("abc")
+	store.Append("ABC", "hello\n")
+	store.Append("DEF", "other")
+	cancel()
+	store.Append("ABC", "missed")
+
+	if line := <-lines; line != "hello" {
+		t.Errorf("followed %q, want hello", line)
+	}
+	select {
+	case line := <-lines:
+		t.Errorf("followed %q after cancel or from another device", line)
+	default:
+	}
+}
+
+func TestStoreInvalidIds(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(filepath.Join(dir, "logs"), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", "../ABC", "A/B", "A.B", "A B"} {
+		if err := store.Append(id, "line"); err == nil {
+			t.Errorf("Append to %q should fail", id)
+		}
+		if _, err := store.Tail(id, 1); err == nil {
+			t.Errorf("Tail of %q should fail", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ABC.log")); !os.IsNotExist(err) {
+		t.Errorf("ABC.log was written outside the store: %v", err)
+	}
+}
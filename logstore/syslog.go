@@ -0,0 +1,146 @@
+package logstore
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxMessageSize is the largest syslog message accepted.
+const MaxMessageSize = 64 << 10
+
+var severities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var facilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "audit", "alert", "clock",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+
+// Message is a parsed RFC 5424 or RFC 3164 syslog message.
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp string // as sent by the device, which may not know the time
+	Hostname  string
+	App       string
+	Text      string
+}
+
+// ReadMessages reads syslog messages framed with octet counting or ending
+// with a newline, as described in RFC 6587, until the stream ends.
+func ReadMessages(r io.Reader, fn func(msg string)) error {
+	reader := bufio.NewReader(r)
+	for {
+		first, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var msg string
+		if first[0] >= '1' && first[0] <= '9' {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return err
+			}
+			size, err := strconv.Atoi(strings.TrimSpace(length))
+			if err != nil || size > MaxMessageSize {
+				return fmt.Errorf("Invalid syslog frame length %q", length)
+			}
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				return err
+			}
+			msg = string(buf)
+		} else {
+			msg, err = reader.ReadString('\n')
+			if err == io.EOF && msg == "" {
+				return nil
+			} else if err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		if msg = strings.TrimRight(msg, "\r\n\x00"); msg != "" {
+			fn(msg)
+		}
+	}
+}
+
+// Parse parses a syslog message. Messages not following either format are
+// kept whole in Text with the default user.notice priority.
+func Parse(raw string) Message {
+	msg := Message{Facility: 1, Severity: 5, Text: raw}
+
+	end := strings.IndexByte(raw, '>')
+	if !strings.HasPrefix(raw, "<") || end < 2 || end > 4 {
+		return msg
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri > 191 {
+		return msg
+	}
+	msg.Facility, msg.Severity = pri/8, pri%8
+	rest := raw[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		fields := strings.SplitN(rest[2:], " ", 6)
+		if len(fields) == 6 {
+			msg.Timestamp, msg.Hostname, msg.App = nilValue(fields[0]), nilValue(fields[1]), nilValue(fields[2])
+			msg.Text = skipStructuredData(fields[5])
+			return msg
+		}
+	} else if len(rest) > 16 {
+		// RFC 3164: TIMESTAMP HOSTNAME TAG: MSG
+		if _, err := time.Parse(time.Stamp, rest[:15]); err == nil && rest[15] == ' ' {
+			msg.Timestamp = rest[:15]
+			rest = rest[16:]
+			if i := strings.IndexByte(rest, ' '); i != -1 && !strings.HasSuffix(rest[:i], ":") {
+				msg.Hostname, rest = rest[:i], rest[i+1:]
+			}
+		}
+	}
+
+	if i := strings.Index(rest, ": "); i != -1 && !strings.ContainsRune(rest[:i], ' ') {
+		msg.App, rest = rest[:i], rest[i+2:]
+	}
+	msg.Text = rest
+	return msg
+}
+
+// Priority returns the facility and severity names, e.g. `daemon.err`.
+func (m Message) Priority() string {
+	facility := strconv.Itoa(m.Facility)
+	if m.Facility < len(facilities) {
+		facility = facilities[m.Facility]
+	}
+	return facility + "." + severities[m.Severity]
+}
+
+func nilValue(field string) string {
+	if field == "-" {
+		return ""
+	}
+	return field
+}
+
+// skipStructuredData removes the structured data preceding the message.
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "- ") {
+		return rest[2:]
+	} else if rest == "-" {
+		return ""
+	}
+	for strings.HasPrefix(rest, "[") {
+		end := strings.Index(rest, "]")
+		if end == -1 {
+			return rest
+		}
+		rest = rest[end+1:]
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(rest, " "), "\xef\xbb\xbf")
+}
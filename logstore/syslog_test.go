@@ -0,0 +1,100 @@
+package logstore
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		raw string
+		msg Message
+	}{
+		{
+			"<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - 'su root' failed",
+			Message{4, 2, "2003-10-11T22:14:15.003Z", "mymachine", "su", "'su root' failed"},
+		},
+		{
+			`<165>1 - - - - - [exampleSDID@32473 iut="3"][other a="b"] ` + "\xef\xbb\xbfstarted",
+			Message{20, 5, "", "", "", "started"},
+		},
+		{
+			"<14>1 - host app 12 - -",
+			Message{1, 6, "", "host", "app", ""},
+		},
+		{
+			"<13>Oct 11 22:14:15 mymachine sshd[42]: Accepted key",
+			Message{1, 5, "Oct 11 22:14:15", "mymachine", "sshd[42]", "Accepted key"},
+		},
+		{
+			"<27>Oct  1 02:04:05 kernel: oops",
+			Message{3, 3, "Oct  1 02:04:05", "", "kernel", "oops"},
+		},
+		{
+			"<30>dhcpd: lease renewed",
+			Message{3, 6, "", "", "dhcpd", "lease renewed"},
+		},
+		{
+			"<30>no tag here: at all",
+			Message{3, 6, "", "", "", "no tag here: at all"},
+		},
+		{"plain text", Message{1, 5, "", "", "", "plain text"}},
+		{"<192>too high", Message{1, 5, "", "", "", "<192>too high"}},
+		{"<>empty", Message{1, 5, "", "", "", "<>empty"}},
+		{"<1234>long", Message{1, 5, "", "", "", "<1234>long"}},
+	}
+	for _, test := range tests {
+		if msg := Parse(test.raw); msg != test.msg {
+			t.Errorf("Parse(%q) = %+v, want %+v", test.raw, msg, test.msg)
+		}
+	}
+}
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		msg      Message
+		priority string
+	}{
+		{Message{Facility: 3, Severity: 3}, "daemon.err"},
+		{Message{Facility: 23, Severity: 7}, "local7.debug"},
+		{Message{Facility: 24, Severity: 0}, "24.emerg"},
+	}
+	for _, test := range tests {
+		if priority := test.msg.Priority(); priority != test.priority {
+			t.Errorf("Priority() of %+v = %q, want %q", test.msg, priority, test.priority)
+		}
+	}
+}
+
+func TestReadMessages(t *testing.T) {
+	tests := []struct {
+		stream string
+		msgs   []string
+		err    bool
+	}{
+		{"<13>one\n<13>two\r\n\n<13>three", []string{"<13>one", "<13>two", "<13>three"}, false},
+		{"7 <13>one9 <13>two\n\n<13>three\n", []string{"<13>one", "<13>two", "<13>three"}, false},
+		{"<13>nul\x00", []string{"<13>nul"}, false},
+		{"", nil, false},
+		{"70000 <13>too long", nil, true},
+		{"12 <13>short", nil, true},
+	}
+	for _, test := range tests {
+		var msgs []string
+		err := ReadMessages(strings.NewReader(test.stream), func(msg string) {
+			msgs = append(msgs, msg)
+		})
+		if test.err {
+			if err == nil {
+				t.Errorf("ReadMessages(%q) read %q, want an error", test.stream, msgs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReadMessages(%q) error: %s", test.stream, err)
+		} else if !reflect.DeepEqual(msgs, test.msgs) {
+			t.Errorf("ReadMessages(%q) read %q, want %q", test.stream, msgs, test.msgs)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/artifact"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// ArtifactsDir is the top-level directory where artifacts are uploaded with
+// scp or sftp, e.g. `scp fw.bin root@brain:/artifacts/`.
+const ArtifactsDir = "artifacts"
+
+func artifactsCommand(ctx CmdContext, args Arguments) int {
+	store := ctx.Server.artifacts
+	if store == nil {
+		fmt.Fprintln(ctx.Stderr(), "Artifact store not configured")
+		return 1
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		fmt.Fprint(ctx, "Name\tSize\tSha256\tUploader\tUploaded\n")
+		for _, a := range store.List() {
+			hash := a.Hash
+			if len(hash) > 12 {
+				hash = hash[:12]
+			}
+			fmt.Fprintf(ctx, "%s\t%d\t%s\t%s\t%s\n", a.Name, a.Size, hash, a.Uploader, a.Uploaded.Format(time.RFC3339))
+		}
+		return 0
+	}
+
+	switch args[0] {
+	case "rm":
+		if len(args) < 2 {
+			return ctx.Usage("Missing name")
+		}
+		if err := store.Delete(args[1]); err != nil {
+			fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+			return 1
+		}
+		ctx.Log.Printf("Artifact %s deleted by %s\n", args[1], ctx.Identity)
+		return 0
+	case "gc":
+		removed, freed, err := store.GC()
+		if err != nil {
+			fmt.Fprintf(ctx.Stderr(), "Error collecting artifacts: %s\n", err)
+			return 1
+		}
+		fmt.Fprintf(ctx, "Removed %d objects, %d bytes freed\n", removed, freed)
+		return 0
+	}
+
+	return ctx.Usage("Unknown command %s", args[0])
+}
+
+// scpArtifacts receives artifacts from or sends one to an scp client.
+func scpArtifacts(ctx CmdContext, opts scpOptions, p string) int {
+	store := ctx.Server.artifacts
+	if store == nil {
+		fmt.Fprintf(ctx, "\x02scp: Artifact store not configured\n")
+		return 1
+	}
+
+	var err error
+	if opts.sink {
+		err = receiveArtifacts(ctx, store, opts, p)
+	} else {
+		err = sendArtifact(ctx, store, path.Base(p))
+	}
+	if err != nil {
+		ctx.Log.Printf("Error transferring artifact: %s\n", err)
+		fmt.Fprintf(ctx, "\x02scp: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// receiveArtifacts acts as an scp sink storing every file received. Files are
+// named after the target path unless it's the artifacts directory itself,
+// which is the only target for several files.
+func receiveArtifacts(ctx CmdContext, store *artifact.Store, opts scpOptions, p string) error {
+	rename := p != "/"
+	if rename && (opts.recursive || opts.targetDir) {
+		return fmt.Errorf("Several files can only be copied to /%s/", ArtifactsDir)
+	}
+
+	src := bufio.NewReader(ctx)
+	ack := []byte{0}
+	if _, err := ctx.Write(ack); err != nil {
+		return err
+	}
+
+	for {
+		kind, err := src.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line, err := src.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case 'T':
+		case 'C':
+			size, name, err := parseScpEntry(string(kind) + line)
+			if err != nil {
+				return err
+			}
+			if rename {
+				name = path.Base(p)
+			}
+			if size > MaxScpFileSize {
+				return fmt.Errorf("%s: file too large (%d > %d bytes)", name, size, MaxScpFileSize)
+			}
+			if !artifact.ValidName(name) {
+				return fmt.Errorf("Invalid artifact name %q", name)
+			}
+			if _, err := ctx.Write(ack); err != nil {
+				return err
+			}
+
+			a, err := receiveArtifact(store, src, name, ctx.Identity, size)
+			if err != nil {
+				return err
+			}
+			ctx.Log.Printf("Artifact %s uploaded by %s (%d bytes, sha256 %s)\n", a.Name, a.Uploader, a.Size, a.Hash)
+		case 'D':
+			return fmt.Errorf("Directories are not supported in %s", ArtifactsDir)
+		case 1, 2:
+			return fmt.Errorf("Source failed: %s", line)
+		default:
+			return fmt.Errorf("Unexpected scp message %q", string(kind)+line)
+		}
+
+		if _, err := ctx.Write(ack); err != nil {
+			return err
+		}
+	}
+}
+
+func receiveArtifact(store *artifact.Store, src *bufio.Reader, name, uploader string, size int64) (artifact.Artifact, error) {
+	tmp, err := store.TempFile()
+	if err != nil {
+		return artifact.Artifact{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.CopyN(tmp, src, size)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return artifact.Artifact{}, err
+	}
+
+	// the source ends the file data with its status
+	if status, err := src.ReadByte(); err != nil {
+		return artifact.Artifact{}, err
+	} else if status != 0 {
+		line, _ := src.ReadString('\n')
+		return artifact.Artifact{}, fmt.Errorf("Source failed: %s", line)
+	}
+
+	return store.Import(name, uploader, tmp.Name())
+}
+
+// sendArtifact acts as an scp source for one artifact.
+func sendArtifact(ctx CmdContext, store *artifact.Store, name string) error {
+	file, a, err := store.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	acks := bufio.NewReader(ctx)
+	if err := readScpAck(acks); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(ctx, "C0644 %d %s\n", a.Size, a.Name); err != nil {
+		return err
+	}
+	if err := readScpAck(acks); err != nil {
+		return err
+	}
+	if _, err := io.Copy(ctx, file); err != nil {
+		return err
+	}
+	if _, err := ctx.Write([]byte{0}); err != nil {
+		return err
+	}
+	return readScpAck(acks)
+}
+
+// artifactUpload is a file written with sftp, imported in the store once
+// closed.
+type artifactUpload struct {
+	*os.File
+	store    *artifact.Store
+	name     string
+	uploader string
+	conn     *SshConnection
+}
+
+func (u *artifactUpload) Close() error {
+	if err := u.File.Close(); err != nil {
+		os.Remove(u.File.Name())
+		return err
+	}
+	a, err := u.store.Import(u.name, u.uploader, u.File.Name())
+	if err != nil {
+		os.Remove(u.File.Name())
+		return err
+	}
+	u.conn.log.Printf("Artifact %s uploaded by %s (%d bytes, sha256 %s)\n", a.Name, a.Uploader, a.Size, a.Hash)
+	return nil
+}
+
+// artifactInfo describes an artifact as a read-only file.
+type artifactInfo struct {
+	a artifact.Artifact
+}
+
+func (i artifactInfo) Name() string       { return i.a.Name }
+func (i artifactInfo) Size() int64        { return i.a.Size }
+func (i artifactInfo) Mode() os.FileMode  { return 0444 }
+func (i artifactInfo) ModTime() time.Time { return i.a.Uploaded }
+func (i artifactInfo) IsDir() bool        { return false }
+func (i artifactInfo) Sys() interface{}   { return nil }
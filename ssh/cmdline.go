@@ -0,0 +1,214 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Flag declares a flag of a command, e.g. `-n <lines>`.
+type Flag struct {
+	Name  string // with its dashes, e.g. -f or --match
+	Value string // name of the value, empty for a boolean flag
+	Desc  string
+
+	complete completer
+}
+
+// Arg declares a positional argument of a command.
+type Arg struct {
+	Name     string
+	Optional bool
+	Variadic bool // takes all the remaining arguments, must be last
+
+	complete completer
+}
+
+// Flags holds the flags given to a command, boolean flags have an empty value.
+type Flags map[string]string
+
+func (f Flags) Has(name string) bool {
+	_, exists := f[name]
+	return exists
+}
+
+func (f Flags) Get(name string) string {
+	return f[name]
+}
+
+// splitPipeline splits a command line like a POSIX shell does: words are
+// separated by blanks, quotes group them and a backslash escapes the next
+// character. Unquoted pipes separate the commands of a pipeline and a final
+// `&` runs it in the background.
+func splitPipeline(line string) (stages []Arguments, background bool, err error) {
+	stages = []Arguments{make(Arguments, 0)}
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			stages[len(stages)-1] = append(stages[len(stages)-1], word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ', '\t', '\r', '\n':
+			endWord()
+		case '|':
+			endWord()
+			stages = append(stages, make(Arguments, 0))
+		case '&':
+			if strings.TrimSpace(line[i+1:]) != "" {
+				return nil, false, fmt.Errorf("Unexpected & before the end of the line")
+			}
+			background = true
+			i = len(line)
+		case '\\':
+			if i+1 == len(line) {
+				return nil, false, fmt.Errorf("Unterminated escape")
+			}
+			i++
+			word.WriteByte(line[i])
+			inWord = true
+		case '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end == -1 {
+				return nil, false, fmt.Errorf("Unterminated quote")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\\\"$`", line[i+1]) != -1 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+			if i == len(line) {
+				return nil, false, fmt.Errorf("Unterminated quote")
+			}
+			inWord = true
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	endWord()
+
+	if len(stages) > 1 || background {
+		for _, stage := range stages {
+			if len(stage) == 0 {
+				return nil, false, fmt.Errorf("Empty command in pipeline")
+			}
+		}
+	}
+	return stages, background, nil
+}
+
+// parse separates the flags from the positional arguments and checks them
+// against the spec of the command. Flags can be anywhere before `--`, and
+// their value can also be given as `--name=value`.
+func (c Cmd) parse(words Arguments) (Flags, Arguments, error) {
+	flags := make(Flags)
+	args := make(Arguments, 0, len(words))
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			args = append(args, words[i+1:]...)
+			break
+		} else if len(word) < 2 || word[0] != '-' {
+			args = append(args, word)
+			continue
+		}
+
+		name, value, hasValue := word, "", false
+		if eq := strings.IndexByte(word, '='); eq != -1 {
+			name, value, hasValue = word[:eq], word[eq+1:], true
+		}
+		flag, exists := c.flag(name)
+		if !exists {
+			return nil, nil, fmt.Errorf("Unknown flag %s", name)
+		}
+		if flag.Value == "" {
+			if hasValue {
+				return nil, nil, fmt.Errorf("Flag %s takes no value", name)
+			}
+		} else if !hasValue {
+			if i+1 == len(words) {
+				return nil, nil, fmt.Errorf("Flag %s needs a value", name)
+			}
+			i++
+			value = words[i]
+		}
+		flags[name] = value
+	}
+
+	min, max := 0, len(c.Args)
+	for _, arg := range c.Args {
+		if !arg.Optional && !arg.Variadic {
+			min++
+		}
+		if arg.Variadic {
+			max = -1
+		}
+	}
+	if len(args) < min {
+		return nil, nil, fmt.Errorf("Missing %s", c.Args[len(args)].Name)
+	} else if max != -1 && len(args) > max {
+		return nil, nil, fmt.Errorf("Unexpected argument %s", args[max])
+	}
+	return flags, args, nil
+}
+
+func (c Cmd) flag(name string) (Flag, bool) {
+	for _, flag := range c.Flags {
+		if flag.Name == name {
+			return flag, true
+		}
+	}
+	return Flag{}, false
+}
+
+// usage describes the command line of a command, e.g.
+// `logs [-f] [-n <lines>] <device-id>`.
+func (c Cmd) usage(name string) string {
+	parts := []string{name}
+	for _, flag := range c.Flags {
+		if flag.Value == "" {
+			parts = append(parts, "["+flag.Name+"]")
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s <%s>]", flag.Name, flag.Value))
+		}
+	}
+	for _, arg := range c.Args {
+		part := "<" + arg.Name + ">"
+		if arg.Variadic {
+			part += "..."
+		}
+		if arg.Optional {
+			part = "[" + part + "]"
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// help prints the usage, description and flags of a command.
+func (c Cmd) help(ctx CmdContext, name string) {
+	fmt.Fprintf(ctx, "Usage: %s\n", c.usage(name))
+	fmt.Fprintf(ctx, "%s\n", c.Description)
+	for _, flag := range c.Flags {
+		fmt.Fprintf(ctx, "  %s\t%s\n", flag.Name, flag.Desc)
+	}
+}
+
+func (c Cmds) names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,108 @@
+package ssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPipeline(t *testing.T) {
+	tests := []struct {
+		line       string
+		stages     []Arguments
+		background bool
+		err        bool
+	}{
+		{"", []Arguments{{}}, false, false},
+		{"  logs  -f\tABC ", []Arguments{{"logs", "-f", "ABC"}}, false, false},
+		{`exec ABC 'ls -l' "a b"`, []Arguments{{"exec", "ABC", "ls -l", "a b"}}, false, false},
+		{`echo 'a"b' "a'b" ''`, []Arguments{{"echo", `a"b`, "a'b", ""}}, false, false},
+		{`echo a'b c'd`, []Arguments{{"echo", "ab cd"}}, false, false},
+		{`echo a\ b \| \& \\`, []Arguments{{"echo", "a b", "|", "&", `\`}}, false, false},
+		{`echo 'a\b'`, []Arguments{{"echo", `a\b`}}, false, false},
+		{`echo "a\"b\\c\d\$"`, []Arguments{{"echo", `a"b\c\d$`}}, false, false},
+		{`echo "a|b" 'c&d'`, []Arguments{{"echo", "a|b", "c&d"}}, false, false},
+		{"logs ABC | grep err|head", []Arguments{{"logs", "ABC"}, {"grep", "err"}, {"head"}}, false, false},
+		{"logs -f ABC &", []Arguments{{"logs", "-f", "ABC"}}, true, false},
+		{"logs ABC | grep err&  ", []Arguments{{"logs", "ABC"}, {"grep", "err"}}, true, false},
+		{"logs ABC & grep err", nil, false, true},
+		{"logs ABC |", nil, false, true},
+		{"| grep err", nil, false, true},
+		{"logs ABC || grep err", nil, false, true},
+		{"&", nil, false, true},
+		{`echo \`, nil, false, true},
+		{`echo 'a`, nil, false, true},
+		{`echo "a\"`, nil, false, true},
+	}
+	for _, test := range tests {
+		stages, background, err := splitPipeline(test.line)
+		if test.err {
+			if err == nil {
+				t.Errorf("splitPipeline(%q) = %q, want an error", test.line, stages)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("splitPipeline(%q) error: %s", test.line, err)
+		} else if !reflect.DeepEqual(stages, test.stages) || background != test.background {
+			t.Errorf("splitPipeline(%q) = %q, %t, want %q, %t", test.line, stages, background, test.stages, test.background)
+		}
+	}
+}
+
+func TestCmdParse(t *testing.T) {
+	cmd := Cmd{
+		Flags: []Flag{
+			{Name: "-f"},
+			{Name: "-n", Value: "lines"},
+			{Name: "--match", Value: "pattern"},
+		},
+		Args: []Arg{
+			{Name: "device-id"},
+			{Name: "path", Optional: true},
+		},
+	}
+	variadic := Cmd{
+		Flags: []Flag{{Name: "-r"}},
+		Args:  []Arg{{Name: "device-id"}, {Name: "command", Variadic: true}},
+	}
+	tests := []struct {
+		cmd   Cmd
+		words Arguments
+		flags Flags
+		args  Arguments
+		err   bool
+	}{
+		{cmd, Arguments{"ABC"}, Flags{}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"-f", "ABC", "/tmp"}, Flags{"-f": ""}, Arguments{"ABC", "/tmp"}, false},
+		{cmd, Arguments{"ABC", "-n", "10", "-f"}, Flags{"-f": "", "-n": "10"}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"-n=10", "ABC"}, Flags{"-n": "10"}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"--match=a=b", "ABC"}, Flags{"--match": "a=b"}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"--match=", "ABC"}, Flags{"--match": ""}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"--match", "-f", "ABC"}, Flags{"--match": "-f"}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"ABC", "-"}, Flags{}, Arguments{"ABC", "-"}, false},
+		{cmd, Arguments{"-f", "--", "-n", "-f"}, Flags{"-f": ""}, Arguments{"-n", "-f"}, false},
+		{cmd, Arguments{"ABC", "--"}, Flags{}, Arguments{"ABC"}, false},
+		{cmd, Arguments{"-x", "ABC"}, nil, nil, true},
+		{cmd, Arguments{"-f=yes", "ABC"}, nil, nil, true},
+		{cmd, Arguments{"ABC", "-n"}, nil, nil, true},
+		{cmd, Arguments{"-f"}, nil, nil, true},
+		{cmd, Arguments{"ABC", "/tmp", "more"}, nil, nil, true},
+		{variadic, Arguments{"ABC", "ls", "-l", "--", "x"}, nil, nil, true},
+		{variadic, Arguments{"-r", "ABC", "--", "ls", "-l"}, Flags{"-r": ""}, Arguments{"ABC", "ls", "-l"}, false},
+		{variadic, Arguments{"ABC"}, Flags{}, Arguments{"ABC"}, false},
+	}
+	for _, test := range tests {
+		flags, args, err := test.cmd.parse(test.words)
+		if test.err {
+			if err == nil {
+				t.Errorf("parse(%q) = %q, %q, want an error", test.words, flags, args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parse(%q) error: %s", test.words, err)
+		} else if !reflect.DeepEqual(flags, test.flags) || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("parse(%q) = %q, %q, want %q, %q", test.words, flags, args, test.flags, test.args)
+		}
+	}
+}
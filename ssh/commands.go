@@ -1,122 +1,498 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"github.com/JeanSebTr/SshBrain/domain"
+	"io"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type CmdContext struct {
 	domain.Channel
-	Log     *log.Logger
-	Manager domain.NodeManager
-	Pty     *domain.PtyRequest
+	// Context is cancelled when the command is interrupted with Ctrl-C or a
+	// signal request, when the session closes or when it times out.
+	Context  context.Context
+	Log      *log.Logger
+	Server   *SshServer // the domain.NodeManager of the devices
+	Identity string     // fingerprint of the admin's key
+	Pty      *domain.PtyRequest
+	Flags    Flags
+	reqs     *sessionRequests
+	exit     *domain.ExitStatus
+	name     string
+	cmd      Cmd
 }
 
+// Attach forwards the requests of the admin session, like window-change or
+// signal, to a device session until the returned function is called.
+func (ctx CmdContext) Attach(session domain.Session) (detach func()) {
+	if ctx.reqs == nil {
+		return func() {}
+	}
+	return ctx.reqs.Attach(session)
+}
+
+// Exit records how a command run on a node terminated, so an exit-signal can
+// be reported to the admin, and returns the matching exit code.
+func (ctx CmdContext) Exit(status domain.ExitStatus) int {
+	if ctx.exit != nil {
+		*ctx.exit = status
+	}
+	return status.Code
+}
+
+// Raw returns the channel of the admin without the line discipline of the
+// brain shell, for commands relaying byte streams. Ctrl-C is passed through
+// instead of interrupting the command until restore is called. In exec mode
+// and in pipelines it is ctx.Channel itself.
+func (ctx CmdContext) Raw() (raw domain.Channel, restore func()) {
+	switch c := ctx.Channel.(type) {
+	case terminalChannel:
+		return c.inputChannel, c.input.interruptWith(nil)
+	case ptyChannel:
+		return c.inputChannel, c.input.interruptWith(nil)
+	case inputChannel:
+		return c, c.input.interruptWith(nil)
+	}
+	return ctx.Channel, func() {}
+}
+
+// Usage reports invalid arguments along with the usage of the command and
+// returns the matching exit code.
+func (ctx CmdContext) Usage(format string, a ...interface{}) int {
+	fmt.Fprintf(ctx.Stderr(), "%s: %s\n", ctx.name, fmt.Sprintf(format, a...))
+	fmt.Fprintf(ctx.Stderr(), "Usage: %s\n", ctx.cmd.usage(ctx.name))
+	return 126
+}
+
+// Cmd is a command of the brain shell, registered with
+// SshServer.RegisterCommand. Its flags and arguments are checked before
+// Handler is called with the positional arguments, the flags being in
+// ctx.Flags.
 type Cmd struct {
-	desc string
-	cb   func(CmdContext, Arguments) int
+	Description string
+	Flags       []Flag
+	Args        []Arg
+	// Role needed by the admin key to run the command, any admin can when empty
+	Role string
+	// Timeout cancels ctx.Context after this duration, never when zero
+	Timeout time.Duration
+	Handler func(CmdContext, Arguments) int
+	// raw commands get all their arguments unchecked, like scp
+	raw bool
+	// readsInput tells if the command reads its input with these arguments,
+	// which background jobs don't have
+	readsInput func(Arguments) bool
 }
 
 type Cmds map[string]Cmd
 
-var commands Cmds
+// builtinCommands are registered on every server by NewServer.
+var builtinCommands Cmds
+
+// RegisterCommand adds a command to the brain shell. Names must be unique and
+// differ from the names of filters.
+func (s *SshServer) RegisterCommand(name string, cmd Cmd) (err error) {
+	if name == "" || cmd.Handler == nil {
+		return fmt.Errorf("Command needs a name and a handler")
+	} else if strings.ContainsAny(name, " \t|'\"\\") {
+		return fmt.Errorf("Invalid command name %s", name)
+	} else if _, exists := filters[name]; exists {
+		return fmt.Errorf("Command %s is already a filter", name)
+	}
+
+	s.a.Run(func() {
+		if _, exists := s.cmds[name]; exists {
+			err = fmt.Errorf("Command %s is already registered", name)
+			return
+		}
+		// copied so the sets returned by commands are never modified
+		cmds := make(Cmds, len(s.cmds)+1)
+		for other, c := range s.cmds {
+			cmds[other] = c
+		}
+		cmds[name] = cmd
+		s.cmds = cmds
+	})
+	return
+}
+
+// commands returns the registered commands, which must not be modified.
+func (s *SshServer) commands() (cmds Cmds) {
+	s.a.Run(func() {
+		cmds = s.cmds
+	})
+	return
+}
+
+// allowed returns the sorted names of the commands identity can run.
+func (c Cmds) allowed(s *SshServer, identity string) []string {
+	names := make([]string, 0, len(c))
+	for _, name := range c.names() {
+		if s.HasRole(identity, c[name].Role) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Exec runs a command line, which may pipe the output of a command through
+// filters like `devices | grep AABB`.
+func (c Cmds) Exec(ctx CmdContext, line string) int {
+	stages, background, err := splitPipeline(line)
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+		return 126
+	} else if len(stages[0]) == 0 {
+		return 0
+	}
+
+	invs := make([]*invocation, len(stages))
+	for i, words := range stages {
+		set := c
+		if i > 0 {
+			set = filters
+		}
+		inv, code := set.prepare(ctx, words)
+		if inv == nil {
+			return code
+		}
+		invs[i] = inv
+	}
+
+	if background {
+		if inv := invs[0]; inv.cmd.readsInput != nil && inv.cmd.readsInput(inv.args) {
+			fmt.Fprintf(ctx.Stderr(), "%s: Background jobs have no input\n", inv.ctx.name)
+			return 126
+		}
+		line = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line), "&"))
+		fmt.Fprintf(ctx, "[%d] started\n", ctx.Server.startJob(ctx, line, invs))
+		return 0
+	}
+	cmdCtx, cancel := interruptible(ctx)
+	defer cancel()
+	return runInvocations(cmdCtx, ctx, invs)
+}
+
+// runInvocations runs a command, or a pipeline, with cmdCtx and reports its
+// timeout.
+func runInvocations(cmdCtx context.Context, ctx CmdContext, invs []*invocation) int {
+	if timeout := invs[0].cmd.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(cmdCtx, timeout)
+		defer cancel()
+	}
+	for _, inv := range invs {
+		inv.ctx.Context = cmdCtx
+	}
+
+	var code int
+	if len(invs) == 1 {
+		code = invs[0].run()
+	} else {
+		code = runPipeline(ctx, invs)
+	}
+	switch cmdCtx.Err() {
+	case context.DeadlineExceeded:
+		fmt.Fprintf(ctx.Stderr(), "%s: Timed out\n", invs[0].ctx.name)
+		return 124
+	case context.Canceled:
+		if code == 0 {
+			code = 130 // killed by SIGINT
+		}
+	}
+	return code
+}
+
+// interruptible returns a context cancelled by Ctrl-C on the input of ctx, by
+// signal requests not forwarded to a device or when the session closes.
+func interruptible(ctx CmdContext) (context.Context, context.CancelFunc) {
+	parent := ctx.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	cmdCtx, cancel := context.WithCancel(parent)
+	var restore []func()
+	switch c := ctx.Channel.(type) {
+	case terminalChannel:
+		restore = append(restore, c.input.interruptWith(cancel))
+	case ptyChannel:
+		restore = append(restore, c.input.interruptWith(cancel))
+	case inputChannel:
+		restore = append(restore, c.input.interruptWith(cancel))
+	}
+	if ctx.reqs != nil {
+		restore = append(restore, ctx.reqs.OnSignal(cancel))
+		go func() {
+			select {
+			case <-ctx.reqs.Done():
+				cancel()
+			case <-cmdCtx.Done():
+			}
+		}()
+	}
+
+	return cmdCtx, func() {
+		for _, r := range restore {
+			r()
+		}
+		cancel()
+	}
+}
+
+// invocation is a command with checked arguments, ready to run.
+type invocation struct {
+	ctx  CmdContext
+	cmd  Cmd
+	args Arguments
+}
+
+func (inv *invocation) run() int {
+	return inv.cmd.Handler(inv.ctx, inv.args)
+}
+
+// prepare finds the command of words and checks its arguments. Errors are
+// reported to the admin and their exit code returned with a nil invocation.
+func (c Cmds) prepare(ctx CmdContext, words Arguments) (*invocation, int) {
+	cmd, exists := c[words[0]]
+	if !exists {
+		fmt.Fprintf(ctx.Stderr(), "%s: Command not found\n", words[0])
+		return nil, 127
+	}
+	ctx.name, ctx.cmd = words[0], cmd
+	if !ctx.Server.HasRole(ctx.Identity, cmd.Role) {
+		fmt.Fprintf(ctx.Stderr(), "%s: Permission denied\n", words[0])
+		return nil, 126
+	}
+	if cmd.raw {
+		return &invocation{ctx, cmd, words[1:]}, 0
+	}
 
-func (c Cmds) Exec(ctx CmdContext, cmd string) int {
-	args := strings.Split(cmd, " ")
-	if cmd, exists := commands[args[0]]; exists {
-		return cmd.cb(ctx, args[1:])
+	flags, args, err := cmd.parse(words[1:])
+	if err != nil {
+		return nil, ctx.Usage("%s", err)
 	}
-	// TODO: fix out of order output
-	fmt.Fprintf(ctx.Stderr(), "%s: Command not found\r\n", cmd)
-	return 127
+	ctx.Flags = flags
+	return &invocation{ctx, cmd, args}, 0
+}
+
+func shellAttached(ctx CmdContext, session domain.Session) (domain.ExitStatus, error) {
+	defer ctx.Attach(session)()
+	defer closeOnDone(ctx.Context, session)()
+	return session.Shell()
+}
+
+func execAttached(ctx CmdContext, session domain.Session, cmd string) (domain.ExitStatus, error) {
+	defer ctx.Attach(session)()
+	defer closeOnDone(ctx.Context, session)()
+	return session.Exec(cmd)
 }
 
 func init() {
-	commands = map[string]Cmd{
-		"help": Cmd{"This help text", func(ctx CmdContext, _ Arguments) int {
-			for name, cmd := range commands {
-				fmt.Fprintf(ctx, "%s\t%s\r\n", name, cmd.desc)
+	builtinCommands = Cmds{
+		"help": Cmd{Description: "This help text, or the usage of a command or filter", Args: []Arg{
+			{Name: "command", Optional: true, complete: completeHelp},
+		}, Handler: func(ctx CmdContext, args Arguments) int {
+			commands := ctx.Server.commands()
+			if len(args) == 1 {
+				cmd, exists := commands[args[0]]
+				if !exists {
+					cmd, exists = filters[args[0]]
+				}
+				if !exists {
+					fmt.Fprintf(ctx.Stderr(), "%s: Command not found\n", args[0])
+					return 1
+				}
+				cmd.help(ctx, args[0])
+				return 0
+			}
+			for _, name := range commands.allowed(ctx.Server, ctx.Identity) {
+				fmt.Fprintf(ctx, "%s\t%s\n", name, commands[name].Description)
+			}
+			fmt.Fprint(ctx, "\nFilters, used as `command | filter`:\n")
+			for _, name := range filters.names() {
+				fmt.Fprintf(ctx, "%s\t%s\n", name, filters[name].Description)
 			}
 			return 0
 		}},
-		"devices": Cmd{"List connected devices", func(ctx CmdContext, _ Arguments) int {
-			fmt.Fprintln(ctx, "Id\tAddr\tServices\r")
-			for _, node := range ctx.Manager.GetAll() {
-				fmt.Fprintf(ctx, "%s\t%s\r\n", node.Id(), node.Address())
+		"devices": Cmd{Description: "List connected devices", Handler: func(ctx CmdContext, _ Arguments) int {
+			fmt.Fprintln(ctx, "Id\tAddr\tServices")
+			for _, node := range ctx.Server.GetAll() {
+				fmt.Fprintf(ctx, "%s\t%s\n", node.Id(), node.Address())
 			}
 			return 0
 		}},
-		"connect": Cmd{"Establish a SSH connection to a device", func(ctx CmdContext, args Arguments) int {
-			log.Printf("Trying to connect to %v\n", args)
-			if len(args) < 1 {
-				fmt.Fprintln(ctx.Stderr(), "Missing client ID\r")
-				return 126
+		"info": Cmd{Description: "Show the details of a device", Args: []Arg{
+			{Name: "device-id", complete: completeDevices},
+		}, Handler: func(ctx CmdContext, args Arguments) int {
+			node, err := ctx.Server.GetById(args[0])
+			if err != nil || node == nil {
+				fmt.Fprintf(ctx.Stderr(), "Node id %s not found\n", args[0])
+				return 1
 			}
-
+			id := strings.ToUpper(node.Id())
+			fmt.Fprintf(ctx, "Id\t%s\n", id)
+			fmt.Fprintf(ctx, "Addr\t%s\n", node.Address())
+			fmt.Fprintf(ctx, "Since\t%s\n", node.LastUpdate().UTC().Format(time.RFC3339))
+			if ctx.Server.inventory != nil {
+				if data, err := ctx.Server.inventory.Device(id); err == nil {
+					fmt.Fprintf(ctx, "Tags\t%s\n", strings.Join(data.Tags, ", "))
+				}
+			}
+			for _, e := range ctx.Server.Exposures() {
+				if e.Device == id {
+					fmt.Fprintf(ctx, "Exposed\t%s on %s\n", portString(e.Port, e.Udp), e.Key())
+				}
+			}
+			return 0
+		}},
+		"connect": Cmd{Description: "Establish a SSH connection to a device", Args: []Arg{
+			{Name: "device-id", complete: completeDevices},
+		}, Handler: func(ctx CmdContext, args Arguments) int {
+			log.Printf("Trying to connect to %v\n", args)
 			target := args[0]
 
-			if node, err := ctx.Manager.GetById(target); err != nil || node == nil {
+			node, err := ctx.Server.GetById(target)
+			if err != nil || node == nil {
 				if err != nil {
 					ctx.Log.Printf("Error finding node id %s: %s\n", target, err)
 				}
-				fmt.Fprintf(ctx.Stderr(), "Node id %s not found\r\n", target)
-			} else if session, err := node.NewSession(ctx.Channel, ctx.Pty); err != nil {
+				fmt.Fprintf(ctx.Stderr(), "Node id %s not found\n", target)
+				return 126
+			}
+
+			raw, restore := ctx.Raw()
+			defer restore()
+			if session, err := node.NewSession(raw, ctx.Pty); err != nil {
 				ctx.Log.Printf("Error creating session on node id %s: %s\n", target, err)
-				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s\r\n", target)
-			} else if err = session.Shell(); err != nil {
+				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s\n", target)
+			} else if status, err := shellAttached(ctx, session); err != nil {
 				ctx.Log.Printf("Error opening shell on node id %s: %s\n", target, err)
-				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s\r\n", target)
+				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s\n", target)
 			} else {
-				return 0
+				return ctx.Exit(status)
 			}
 			return 126
+		}, readsInput: func(Arguments) bool {
+			return true
 		}},
-		"scp": Cmd{"Copy data to remote nodes", func(ctx CmdContext, args Arguments) int {
-			path, err := args.Single(func(str string) bool {
-				return len(str) > 0 && str[0] == '/'
-			})
+		"tunnel": Cmd{Description: "Pipe stdin and stdout to a TCP port on a device", Args: []Arg{
+			{Name: "device-id", complete: completeDevices},
+			{Name: "port"},
+		}, Handler: func(ctx CmdContext, args Arguments) int {
+			target := args[0]
+			port, err := strconv.ParseUint(args[1], 10, 16)
 			if err != nil {
-				fmt.Fprintln(ctx.Stderr(), "Destination path not found in command")
-				return 126
-			}
-
-			target := path[1:]
-			nodePath := "/"
-			if i := strings.IndexByte(target, '/'); i != -1 {
-				target = path[1 : i+1]
-				nodePath = path[i+1:]
-			}
-
-			newArgs := make(Arguments, len(args)+1)
-			newArgs[0] = "scp"
-			for i, arg := range args {
-				if arg == path {
-					newArgs[i+1] = nodePath
-				} else {
-					newArgs[i+1] = arg
-				}
+				return ctx.Usage("Invalid port %s", args[1])
 			}
 
-			cmd := newArgs.String()
-
-			if node, err := ctx.Manager.GetById(target); err != nil || node == nil {
+			if node, err := ctx.Server.GetById(target); err != nil || node == nil {
 				if err != nil {
 					ctx.Log.Printf("Error finding node id %s: %s\n", target, err)
 				}
-				fmt.Fprintf(ctx.Stderr(), "Node id %s not found\r\n", target)
-			} else if session, err := node.NewSession(ctx.Channel, ctx.Pty); err != nil {
-				ctx.Log.Printf("Error creating session on node id %s: %s\n", target, err)
-				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s\r\n", target)
-			} else if exitCode, err := session.Exec(cmd); err != nil {
-				ctx.Log.Printf("Error running command `%s` on node id %s: %s\n", cmd, target, err)
-				fmt.Fprintf(ctx.Stderr(), "Error running command `%s` on %s\r\n", cmd, target)
+				fmt.Fprintf(ctx.Stderr(), "Node id %s not found\n", target)
+			} else if conn, err := node.Dial("127.0.0.1", uint32(port)); err != nil {
+				ctx.Log.Printf("Error dialing port %d on node id %s: %s\n", port, target, err)
+				fmt.Fprintf(ctx.Stderr(), "Error connecting to %s:%d\n", target, port)
 			} else {
-				return exitCode
-			}
+				defer conn.Close()
+				defer closeOnDone(ctx.Context, conn)()
+				raw, restore := ctx.Raw()
+				defer restore()
 
+				// the input of the admin is left to the shell once the tunnel closes
+				stop, copied := make(chan struct{}), make(chan struct{})
+				stdin, waitable := stoppableReader(raw, stop)
+				go func() {
+					defer close(copied)
+					io.Copy(conn, stdin)
+					if cw, ok := conn.(closeWriter); ok {
+						cw.CloseWrite()
+					}
+				}()
+				_, err := io.Copy(raw, conn)
+				close(stop)
+				if waitable {
+					<-copied
+				}
+				if err != nil {
+					ctx.Log.Printf("Error on tunnel to %s:%d: %s\n", target, port, err)
+					return 1
+				}
+				return 0
+			}
 			return 126
+		}, readsInput: func(Arguments) bool {
+			return true
+		}},
+		"ssh-config": Cmd{Description: "Print an ssh_config snippet to use the brain as a jump host", Args: []Arg{
+			{Name: "brain-host", Optional: true},
+		}, Handler: func(ctx CmdContext, args Arguments) int {
+			brain := "brain"
+			if len(args) > 0 {
+				brain = args[0]
+			}
+			fmt.Fprintf(ctx, "Host *%s\n", DevicesDomain)
+			fmt.Fprintf(ctx, "\tUser root\n")
+			fmt.Fprintf(ctx, "\tProxyJump root@%s\n", brain)
+			return 0
+		}},
+		"artifacts": Cmd{Description: "List, delete (rm <name>) or garbage-collect (gc) uploaded artifacts", Args: []Arg{
+			{Name: "command", Optional: true, complete: completeWords("list", "rm", "gc")},
+			{Name: "name", Optional: true, complete: completeArtifacts},
+		}, Handler: artifactsCommand},
+		"config": Cmd{Description: "List config templates, or show the vars or rendered config of a device", Args: []Arg{
+			{Name: "device-id", Optional: true, complete: completeDevices},
+			{Name: "template", Optional: true, complete: completeTemplates},
+		}, Handler: configCommand},
+		"expose": Cmd{Description: "List exposed device ports, or expose one with <device-id>:<port>[/udp] on <brain-port|address>, a port listens on 127.0.0.1", Args: []Arg{
+			{Name: "device-id:port", Optional: true, complete: completeDevicePorts},
+			{Name: "on", Optional: true, complete: completeWords("on")},
+			{Name: "brain-port", Optional: true},
+		}, Handler: exposeCommand},
+		"unexpose": Cmd{Description: "Close the listener of an exposed device port", Args: []Arg{
+			{Name: "brain-port", complete: completeExposures},
+		}, Handler: unexposeCommand},
+		"logs": Cmd{Description: "Show the logs of a device", Flags: []Flag{
+			{Name: "-f", Desc: "Follow the logs until interrupted with Ctrl-C"},
+			{Name: "-n", Value: "lines", Desc: "Number of lines to show, 50 by default"},
+		}, Args: []Arg{
+			{Name: "device-id", complete: completeDevices},
+		}, Handler: logsCommand},
+		"push": Cmd{Description: "Push a local file, an artifact (artifact:<name>) or stdin (-) to many devices and verify its checksum", Flags: []Flag{
+			{Name: "--match", Value: "selector", Desc: "Glob pattern of the device ids to push to", complete: completeDevices},
+		}, Args: []Arg{
+			{Name: "source", complete: completeArtifactSources},
+			{Name: "remote-path"},
+		}, Handler: pushCommand, readsInput: func(args Arguments) bool {
+			return args[0] == "-"
+		}},
+		"history": Cmd{Description: "Show the commands typed in the brain shell with this key", Flags: []Flag{
+			{Name: "-n", Value: "lines", Desc: "Number of commands to show"},
+			{Name: "-c", Desc: "Clear the history"},
+		}, Args: []Arg{
+			{Name: "filter", Optional: true},
+		}, Handler: historyCommand},
+		"jobs": Cmd{Description: "List the background jobs, started by ending a command line with &", Handler: jobsCommand},
+		"job": Cmd{Description: "Show the output of a background job, or cancel it, the jobs of other admins needing the " + JobsRole + " role", Args: []Arg{
+			{Name: "job-id", complete: completeJobs},
+			{Name: "log|cancel", complete: completeWords("log", "cancel")},
+		}, Handler: jobCommand},
+		"wall": Cmd{Description: "Send a message to every admin in the brain shell", Args: []Arg{
+			{Name: "message", Variadic: true},
+		}, Handler: wallCommand},
+		"services": Cmd{Description: "List the services offered to devices, add one (add <http-proxy|udp-relay> <name:port=...> [devices=<glob>,...]) or remove one (rm <name>) with the services role", Args: []Arg{
+			{Name: "command", Optional: true, complete: completeWords("list", "add", "rm")},
+			{Name: "kind|name", Optional: true},
+			{Name: "spec", Optional: true},
+			{Name: "devices=glob", Optional: true},
+		}, Handler: servicesCommand},
+		"scp": Cmd{Description: "Copy files to and from devices, used by `scp -O`", raw: true, Handler: scpCommand, readsInput: func(Arguments) bool {
+			return true
 		}},
 	}
 }
@@ -0,0 +1,106 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// execLine runs line in the brain shell of server as the admin with identity.
+func execLine(server *SshServer, identity, line string) (code int, stdout, stderr string) {
+	var out, errOut bytes.Buffer
+	ctx := CmdContext{
+		Channel:  pipeChannel{strings.NewReader(""), &out, stderrChannel{&errOut}},
+		Context:  context.Background(),
+		Log:      log.New(ioutil.Discard, "", 0),
+		Server:   server,
+		Identity: identity,
+	}
+	code = server.commands().Exec(ctx, line)
+	return code, out.String(), errOut.String()
+}
+
+func TestBackgroundJobsWithInputRefused(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, line := range []string{
+		"connect AABBCCDDEEFF &",
+		"tunnel AABBCCDDEEFF 80 &",
+		"scp -t /tmp &",
+	} {
+		code, _, stderr := execLine(server, "SHA256:admin", line)
+		if code != 126 || !strings.Contains(stderr, "Background jobs have no input") {
+			t.Errorf("%q = %d %q, want it refused", line, code, stderr)
+		}
+	}
+	if jobs := server.jobList(); len(jobs) != 0 {
+		t.Errorf("%d jobs started", len(jobs))
+	}
+}
+
+func TestServicesChangesNeedRole(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := ssh.FingerprintSHA256(pubkey)
+	path := filepath.Join(t.TempDir(), "services.json")
+
+	server, _ := newTestServer(t)
+	if err := server.RestoreServices(path); err != nil {
+		t.Fatal(err)
+	}
+	add := "services add udp-relay dns:5353=127.0.0.1:53 devices=AABB*,ccdd*"
+	if code, _, stderr := execLine(server, identity, add); code != 126 || !strings.Contains(stderr, "Permission denied") {
+		t.Errorf("add without the services role = %d %q", code, stderr)
+	}
+	if code, _, _ := execLine(server, identity, "services"); code != 0 {
+		t.Errorf("list without the services role = %d", code)
+	}
+	if err := server.GrantRole(ServicesRole, string(ssh.MarshalAuthorizedKey(pubkey))); err != nil {
+		t.Fatal(err)
+	}
+	if code, _, stderr := execLine(server, identity, "services add udp-relay dns:5353=127.0.0.1:53 devices=["); code != 1 {
+		t.Errorf("add with an invalid pattern = %d %q", code, stderr)
+	}
+	if code, _, stderr := execLine(server, identity, add); code != 0 {
+		t.Fatalf("add with the services role = %d %q", code, stderr)
+	}
+
+	// the ACL is restored with the service
+	restored, _ := newTestServer(t)
+	if err := restored.RestoreServices(path); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, svc := range restored.Services() {
+		if svc.Name == "dns" {
+			found = true
+			if !reflect.DeepEqual(svc.Devices, []string{"AABB*", "ccdd*"}) {
+				t.Errorf("restored devices %q", svc.Devices)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("dns service not restored")
+	}
+
+	if code, _, stderr := execLine(server, "SHA256:other", "services rm dns"); code != 126 {
+		t.Errorf("rm without the services role = %d %q", code, stderr)
+	}
+	if code, _, stderr := execLine(server, identity, "services rm dns"); code != 0 {
+		t.Errorf("rm with the services role = %d %q", code, stderr)
+	}
+}
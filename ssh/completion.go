@@ -0,0 +1,198 @@
+package ssh
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// completer returns the candidates for an argument starting with prefix.
+// Candidates don't have to start with prefix, e.g. devices matched by tag.
+type completer func(t *TerminalSession, prefix string) []string
+
+// complete returns the line with the word before pos completed. Candidates
+// are listed when completing twice in a row doesn't change the line.
+func (t *TerminalSession) complete(line string, pos int) (string, int, bool) {
+	again := t.lastTab
+	t.lastTab = true
+
+	start := strings.LastIndexAny(line[:pos], " |") + 1
+	prefix := line[start:pos]
+	before, set := line[:start], t.server.commands()
+	if pipe := strings.LastIndexByte(before, '|'); pipe != -1 {
+		before, set = before[pipe+1:], filters
+	}
+	candidates := t.candidates(set, strings.Fields(before), prefix)
+	if len(candidates) == 0 {
+		return line, pos, false
+	}
+
+	replacement := candidates[0]
+	if !strings.HasSuffix(replacement, ":") {
+		replacement += " "
+	}
+	if len(candidates) > 1 {
+		replacement = commonPrefix(candidates)
+		if len(replacement) <= len(prefix) || !strings.EqualFold(replacement[:len(prefix)], prefix) {
+			if again {
+				go t.listCandidates(candidates)
+			}
+			return line, pos, false
+		}
+	}
+	t.lastTab = false
+	return line[:start] + replacement + line[pos:], start + len(replacement), true
+}
+
+// candidates completes prefix according to the flags and arguments of the
+// command of set in words.
+func (t *TerminalSession) candidates(set Cmds, words []string, prefix string) []string {
+	if len(words) == 0 {
+		return matchPrefix(set.allowed(t.server, t.conn.KeyFingerprint()), prefix)
+	}
+	cmd, exists := set[words[0]]
+	if !exists || cmd.raw {
+		return nil
+	}
+
+	arg := 0
+	for i := 1; i < len(words); i++ {
+		flag, isFlag := cmd.flag(words[i])
+		if !isFlag {
+			arg++
+		} else if flag.Value != "" {
+			if i++; i == len(words) {
+				return complete(flag.complete, t, prefix)
+			}
+		}
+	}
+
+	if strings.HasPrefix(prefix, "-") {
+		names := make([]string, len(cmd.Flags))
+		for i, flag := range cmd.Flags {
+			names[i] = flag.Name
+		}
+		return matchPrefix(names, prefix)
+	}
+	if arg >= len(cmd.Args) {
+		if len(cmd.Args) == 0 || !cmd.Args[len(cmd.Args)-1].Variadic {
+			return nil
+		}
+		arg = len(cmd.Args) - 1
+	}
+	return complete(cmd.Args[arg].complete, t, prefix)
+}
+
+func complete(c completer, t *TerminalSession, prefix string) []string {
+	if c == nil {
+		return nil
+	}
+	return c(t, prefix)
+}
+
+// listCandidates prints the candidates above the line being edited. It runs
+// in its own goroutine since the terminal is locked during completion.
+func (t *TerminalSession) listCandidates(candidates []string) {
+	fmt.Fprintf(t.term, "%s\n", strings.Join(candidates, "  "))
+}
+
+func completeHelp(t *TerminalSession, prefix string) []string {
+	names := t.server.commands().allowed(t.server, t.conn.KeyFingerprint())
+	return matchPrefix(append(names, filters.names()...), prefix)
+}
+
+// completeDevices matches connected devices by id prefix or by tag prefix.
+func completeDevices(t *TerminalSession, prefix string) []string {
+	var ids []string
+	for _, node := range t.server.GetAll() {
+		id := strings.ToUpper(node.Id())
+		if strings.HasPrefix(id, strings.ToUpper(prefix)) {
+			ids = append(ids, id)
+		} else if prefix != "" && t.server.inventory != nil {
+			if data, err := t.server.inventory.Device(id); err == nil && len(matchPrefix(data.Tags, prefix)) > 0 {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// completeDevicePorts completes device ids followed by the port separator,
+// like `expose AABBCCDDEEFF:80 on 8080`.
+func completeDevicePorts(t *TerminalSession, prefix string) []string {
+	if strings.ContainsRune(prefix, ':') {
+		return nil
+	}
+	ids := completeDevices(t, prefix)
+	for i, id := range ids {
+		ids[i] = id + ":"
+	}
+	return ids
+}
+
+func completeTemplates(t *TerminalSession, prefix string) []string {
+	if t.server.inventory == nil {
+		return nil
+	}
+	names, _ := t.server.inventory.Templates()
+	return matchPrefix(names, prefix)
+}
+
+func completeArtifacts(t *TerminalSession, prefix string) []string {
+	if t.server.artifacts == nil {
+		return nil
+	}
+	var names []string
+	for _, a := range t.server.artifacts.List() {
+		names = append(names, a.Name)
+	}
+	return matchPrefix(names, prefix)
+}
+
+func completeArtifactSources(t *TerminalSession, prefix string) []string {
+	if !strings.HasPrefix(prefix, "artifact:") {
+		return matchPrefix([]string{"artifact:"}, prefix)
+	}
+	names := completeArtifacts(t, strings.TrimPrefix(prefix, "artifact:"))
+	for i, name := range names {
+		names[i] = "artifact:" + name
+	}
+	return names
+}
+
+func completeExposures(t *TerminalSession, prefix string) []string {
+	var keys []string
+	for _, e := range t.server.Exposures() {
+		keys = append(keys, e.Key())
+	}
+	return matchPrefix(keys, prefix)
+}
+
+func completeWords(words ...string) completer {
+	return func(t *TerminalSession, prefix string) []string {
+		return matchPrefix(words, prefix)
+	}
+}
+
+// matchPrefix returns the sorted words starting with prefix, ignoring case.
+func matchPrefix(words []string, prefix string) []string {
+	var matches []string
+	for _, word := range words {
+		if strings.HasPrefix(strings.ToLower(word), strings.ToLower(prefix)) {
+			matches = append(matches, word)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,135 @@
+package ssh
+
+import (
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/inventory"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigService returns a service handler serving over HTTP the configuration
+// of the connecting device, e.g. `wget -O /etc/config/wireless
+// http://127.0.0.1:8081/wireless` through `ssh -L 8081:config:0 brain`.
+// GET / lists the available templates. Devices are identified by their user
+// name, which only the Keys of their inventory entry authenticate.
+func ConfigService(store *inventory.Store) ServiceCallback {
+	return func(client *SshConnection, conn net.Conn) {
+		id := strings.ToUpper(client.User())
+		server := &http.Server{
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				serveConfig(client, store, id, w, req)
+			}),
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+		server.Serve(newConnListener(conn))
+	}
+}
+
+func serveConfig(client *SshConnection, store *inventory.Store, id string, w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(req.URL.Path, "/")
+	if name == "" {
+		names, err := store.Templates()
+		if err != nil {
+			client.log.Printf("Error listing config templates: %s\n", err)
+			http.Error(w, "Error listing templates", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+		return
+	}
+
+	if allowed, err := store.Allows(id, client.KeyFingerprint()); err != nil {
+		client.log.Printf("Error reading inventory: %s\n", err)
+		http.Error(w, "Error reading inventory", http.StatusInternalServerError)
+		return
+	} else if !allowed {
+		client.log.Printf("Config %s of %s refused to key %s\n", name, id, client.KeyFingerprint())
+		http.Error(w, "Key not allowed for "+id, http.StatusForbidden)
+		return
+	}
+
+	config, err := store.Render(id, name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		client.log.Printf("Error rendering config %s of %s: %s\n", name, id, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	client.log.Printf("Config %s fetched by %s\n", name, id)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(config)
+}
+
+// SetInventory enables the config command to preview device configurations.
+func (s *SshServer) SetInventory(store *inventory.Store) {
+	s.inventory = store
+}
+
+// configCommand lists the templates or shows the configuration a device
+// would fetch.
+func configCommand(ctx CmdContext, args Arguments) int {
+	store := ctx.Server.inventory
+	if store == nil {
+		fmt.Fprintln(ctx.Stderr(), "Inventory not configured")
+		return 1
+	}
+
+	switch len(args) {
+	default:
+		names, err := store.Templates()
+		if err != nil {
+			fmt.Fprintf(ctx.Stderr(), "Error listing templates: %s\n", err)
+			return 1
+		}
+		for _, name := range names {
+			fmt.Fprintf(ctx, "%s\n", name)
+		}
+		return 0
+	case 1:
+		data, err := store.Device(args[0])
+		if err != nil {
+			fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+			return 1
+		}
+		fmt.Fprintf(ctx, "Tags: %s\n", strings.Join(data.Tags, ", "))
+		for _, k := range sortedKeys(data.Vars) {
+			fmt.Fprintf(ctx, "%s\t%v\n", k, data.Vars[k])
+		}
+		return 0
+	case 2:
+		config, err := store.Render(args[0], args[1])
+		if os.IsNotExist(err) {
+			fmt.Fprintf(ctx.Stderr(), "No template %s\n", args[1])
+			return 1
+		} else if err != nil {
+			fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+			return 1
+		}
+		ctx.Write(config)
+		return 0
+	}
+}
+
+func sortedKeys(vars map[string]interface{}) []string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
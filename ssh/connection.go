@@ -2,10 +2,12 @@ package ssh
 
 import (
 	"fmt"
+	"github.com/JeanSebTr/SshBrain/domain"
 	"golang.org/x/crypto/ssh"
 	"log"
 	"net"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -44,6 +46,20 @@ func (s *SshConnection) User() string {
 	return s.conn.User()
 }
 
+func (s *SshConnection) isAdmin() bool {
+	return isAdminUser(s.conn.User())
+}
+
+// deviceTarget returns the node id an admin session is routed to when logged
+// in as `admin+<device-id>`.
+func (s *SshConnection) deviceTarget() (string, bool) {
+	user := s.conn.User()
+	if strings.HasPrefix(user, DeviceUserPrefix) {
+		return user[len(DeviceUserPrefix):], true
+	}
+	return "", false
+}
+
 func (s *SshConnection) PublicKey() string {
 	if key, exists := s.conn.Permissions.Extensions["key-id"]; exists {
 		return key
@@ -52,7 +68,35 @@ func (s *SshConnection) PublicKey() string {
 	}
 }
 
+// KeyFingerprint identifies the key used to authenticate, e.g. an admin's.
+func (s *SshConnection) KeyFingerprint() string {
+	if fp, exists := s.conn.Permissions.Extensions["key-fp"]; exists {
+		return fp
+	} else {
+		return "NONE"
+	}
+}
+
 func (s *SshConnection) Dial(address string, port uint32) (net.Conn, error) {
+	conn, err := s.openChannel("forwarded-tcpip", address, port)
+	if err != nil {
+		return nil, err
+	}
+	go conn.logAndRejectRequests()
+	return conn, nil
+}
+
+// DialUDP opens a UDP channel to a port reachable from the other side.
+func (s *SshConnection) DialUDP(address string, port uint32) (*UdpChannel, error) {
+	conn, err := s.openChannel(UdpChannelType, address, port)
+	if err != nil {
+		return nil, err
+	}
+	go conn.logAndRejectRequests()
+	return NewUdpChannel(conn), nil
+}
+
+func (s *SshConnection) openChannel(kind string, address string, port uint32) (*TcpChannel, error) {
 	s.m.Lock()
 	defer s.m.Unlock()
 
@@ -75,10 +119,8 @@ func (s *SshConnection) Dial(address string, port uint32) (net.Conn, error) {
 		return nil, err
 	}
 
-	if channel, reqs, err := s.conn.OpenChannel("forwarded-tcpip", msg); err == nil {
-		conn := NewTcpChannel(rAddr, lAddr, channel, reqs, s.log)
-		go conn.logAndRejectRequests()
-		return conn, nil
+	if channel, reqs, err := s.conn.OpenChannel(kind, msg); err == nil {
+		return NewTcpChannel(rAddr, lAddr, channel, reqs, s.log), nil
 	} else {
 		return nil, err
 	}
@@ -150,13 +192,39 @@ func (s *SshConnection) handleNewChannel(newChan ssh.NewChannel) {
 		reqData := &DirectTcpipOpenRequest{}
 		if err := ssh.Unmarshal(newChan.ExtraData(), reqData); err != nil {
 			s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrParsing, err)
+		} else if node, err := s.findTunnelTarget(reqData); err != nil {
+			s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
+		} else if node != nil {
+			// dialing a slow device must not hold the other channels
+			go func() {
+				if err := s.createDeviceConnection(newChan, node, reqData); err != nil {
+					s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
+				}
+			}()
 		} else {
 			if err := s.createServiceConnection(newChan, reqData); err != nil {
 				s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
 			}
 		}
+	} else if channelType == UdpChannelType {
+		reqData := &DirectTcpipOpenRequest{}
+		if err := ssh.Unmarshal(newChan.ExtraData(), reqData); err != nil {
+			s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrParsing, err)
+		} else if node, err := s.findTunnelTarget(reqData); err != nil {
+			s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
+		} else if node != nil {
+			go func() {
+				if err := s.createDeviceUdpConnection(newChan, node, reqData); err != nil {
+					s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
+				}
+			}()
+		} else {
+			if err := s.createUdpServiceConnection(newChan, reqData); err != nil {
+				s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, err)
+			}
+		}
 	} else if channelType == "session" {
-		if s.conn.User() != "root" {
+		if !s.isAdmin() {
 			s.rejectNewChannelWithError(newChan, ssh.Prohibited, ErrUnauthorized, fmt.Errorf("Session refused for user %s", s.conn.User()))
 		} else {
 			go s.startSession(newChan)
@@ -174,10 +242,11 @@ func (s *SshConnection) createServiceConnection(newChan ssh.NewChannel, reqData
 	}
 	lAddr, err := reqData.HostAddr()
 	if err != nil {
-		return err
+		// services can be addressed by name
+		lAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(reqData.PortToConnect)}
 	}
 
-	s.server.handleServiceRequest(reqData.PortToConnect, s, func() (net.Conn, error) {
+	return s.server.handleServiceRequest(reqData.HostToConnect, reqData.PortToConnect, false, s, func() (net.Conn, error) {
 		channel, reqs, err := newChan.Accept()
 		if err != nil {
 			return nil, err
@@ -188,10 +257,103 @@ func (s *SshConnection) createServiceConnection(newChan ssh.NewChannel, reqData
 
 		return conn, nil
 	})
+}
+
+// findTunnelTarget returns the node an admin's direct-tcpip channel should be
+// routed to, or nil if the channel is for a service exposed by the brain.
+// Hosts named `<device-id>.devices` always designate a node, which lets
+// admins use the brain as a jump host (`ssh -J root@brain root@<id>.devices`).
+func (s *SshConnection) findTunnelTarget(reqData *DirectTcpipOpenRequest) (domain.Node, error) {
+	if !s.isAdmin() {
+		return nil, nil
+	}
+
+	id, isDeviceHost := deviceIdFromHost(reqData.HostToConnect)
+	node, err := s.server.GetById(id)
+	if err != nil {
+		s.log.Printf("Error finding node id %s: %s\n", id, err)
+	}
+	if node == nil && isDeviceHost {
+		return nil, fmt.Errorf("Node id %s not found", id)
+	}
+	return node, nil
+}
+
+func (s *SshConnection) createDeviceConnection(newChan ssh.NewChannel, node domain.Node, reqData *DirectTcpipOpenRequest) error {
+	conn, err := node.Dial("127.0.0.1", reqData.PortToConnect)
+	if err != nil {
+		return fmt.Errorf("Error dialing port %d on node id %s: %s", reqData.PortToConnect, node.Id(), err)
+	}
+
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		s.log.Printf("Error accepting tunnel to %s:%d: %s\n", node.Id(), reqData.PortToConnect, err)
+		return nil
+	}
+	go ssh.DiscardRequests(reqs)
+
+	s.log.Printf("Tunnel opened from %s:%d to %s:%d\n", reqData.OriginatorIPAddress, reqData.OriginatorPort, node.Id(), reqData.PortToConnect)
+	go func() {
+		splice(channel, conn)
+		s.log.Printf("Tunnel closed from %s:%d to %s:%d\n", reqData.OriginatorIPAddress, reqData.OriginatorPort, node.Id(), reqData.PortToConnect)
+	}()
+	return nil
+}
+
+func (s *SshConnection) createUdpServiceConnection(newChan ssh.NewChannel, reqData *DirectTcpipOpenRequest) error {
+	rAddr, err := reqData.OriginatorAddr()
+	if err != nil {
+		return err
+	}
+	lAddr, err := reqData.HostAddr()
+	if err != nil {
+		lAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(reqData.PortToConnect)}
+	}
+
+	return s.server.handleServiceRequest(reqData.HostToConnect, reqData.PortToConnect, true, s, func() (net.Conn, error) {
+		channel, reqs, err := newChan.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		conn := NewTcpChannel(rAddr, lAddr, channel, reqs, s.log)
+		go conn.logAndRejectRequests()
+
+		return NewUdpChannel(conn), nil
+	})
+}
+
+func (s *SshConnection) createDeviceUdpConnection(newChan ssh.NewChannel, node domain.Node, reqData *DirectTcpipOpenRequest) error {
+	conn, err := node.DialUDP("127.0.0.1", reqData.PortToConnect)
+	if err != nil {
+		return fmt.Errorf("Error dialing UDP port %d on node id %s: %s", reqData.PortToConnect, node.Id(), err)
+	}
+
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		s.log.Printf("Error accepting UDP tunnel to %s:%d: %s\n", node.Id(), reqData.PortToConnect, err)
+		return nil
+	}
+	go ssh.DiscardRequests(reqs)
+
+	rAddr, _ := reqData.OriginatorAddr()
+	lAddr, _ := reqData.HostAddr()
+	s.log.Printf("UDP tunnel opened from %s:%d to %s:%d\n", reqData.OriginatorIPAddress, reqData.OriginatorPort, node.Id(), reqData.PortToConnect)
+	go func() {
+		relayDatagrams(NewUdpChannel(NewTcpChannel(rAddr, lAddr, channel, nil, s.log)), conn)
+		s.log.Printf("UDP tunnel closed from %s:%d to %s:%d\n", reqData.OriginatorIPAddress, reqData.OriginatorPort, node.Id(), reqData.PortToConnect)
+	}()
 	return nil
 }
 
 func (s *SshConnection) startSession(newChan ssh.NewChannel) {
+	if id, ok := s.deviceTarget(); ok {
+		s.proxySession(newChan, id)
+		return
+	}
+
 	s.log.Println("Starting session")
 	channel, reqs, err := newChan.Accept()
 	if err != nil {
@@ -200,16 +362,30 @@ func (s *SshConnection) startSession(newChan ssh.NewChannel) {
 	}
 	defer channel.Close()
 
-	var isShell bool
+	sessionReqs := newSessionRequests(s)
+	started := false
+	var isShell, isSftp bool
 	var cmd struct {
 		Line string
 	}
-	savedReqs := make([]*ssh.Request, 0)
 ReqLoop:
 	for req := range reqs {
 		switch req.Type {
-		case "pty-req":
-			savedReqs = append(savedReqs, req)
+		case "subsystem":
+			subsystem := SubsystemRequest{}
+			if err := ssh.Unmarshal(req.Payload, &subsystem); err != nil || subsystem.Name != "sftp" {
+				s.log.Printf("Refusing subsystem `%s`\n", subsystem.Name)
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+				continue
+			}
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			isSftp = true
+			started = true
+			break ReqLoop
 		case "shell", "exec":
 			if req.Type == "shell" {
 				isShell = true
@@ -220,57 +396,139 @@ ReqLoop:
 				}
 				return
 			}
-			defer func() {
-				log.Println("fucking defer!!!!")
-				if req.WantReply {
-					req.Reply(true, nil)
-				}
-			}()
-			break ReqLoop
-		default:
-			s.log.Printf("Unknown req %s(%v) %v\r\n", req.Type, req.Payload, req.WantReply)
 			if req.WantReply {
-				req.Reply(false, []byte("Unknown request type"))
+				req.Reply(true, nil)
 			}
+			started = true
+			break ReqLoop
+		default:
+			sessionReqs.handle(req)
 		}
 	}
+	if !started {
+		return
+	}
 
-	// TODO close newReqs
-	newReqs := make(chan *ssh.Request)
+	go sessionReqs.serve(reqs)
 
-	go func() {
-		for _, req := range savedReqs {
-			newReqs <- req
+	if isSftp {
+		code := uint32(0)
+		if err := s.serveSftp(channel); err != nil {
+			s.log.Printf("Error serving SFTP: %s\n", err)
+			code = 1
+		}
+		channel.SendRequest("exit-status", false, ssh.Marshal(ExitStatusRequest{code}))
+	} else if isShell {
+		s.startShell(channel, sessionReqs)
+	} else {
+		status := s.execCmd(channel, sessionReqs, cmd.Line)
+		if err := sendExitStatus(channel, status); err != nil {
+			s.log.Printf("Error sending exit status: %s\n", err)
 		}
+	}
+}
+
+// proxySession relays a session channel and all its requests (pty-req, shell,
+// exec, subsystem, ...) to a new session on the node.
+func (s *SshConnection) proxySession(newChan ssh.NewChannel, id string) {
+	node := s.server.getNode(id)
+	if node == nil {
+		s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, fmt.Errorf("Node id %s not found", id))
+		return
+	}
+
+	nodeChannel, nodeReqs, err := node.OpenChannel("session", newChan.ExtraData())
+	if err != nil {
+		s.rejectNewChannelWithError(newChan, ssh.ConnectionFailed, ErrAddr, fmt.Errorf("Error creating session on node id %s: %s", id, err))
+		return
+	}
 
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		nodeChannel.Close()
+		s.log.Println("Error accepting session: ", err)
+		return
+	}
+
+	// Channels opened back by the node for agent or X11 forwarding are routed
+	// to this connection once the admin asks for them.
+	adminReqs := make(chan *ssh.Request)
+	var m sync.Mutex
+	var releases []func()
+	closed := false
+	go func() {
 		for req := range reqs {
-			newReqs <- req
+			if kind, ok := forwardedChannelTypes[req.Type]; ok {
+				release := node.setForwardTarget(kind, nodeChannel, s)
+				m.Lock()
+				if closed {
+					release()
+				} else {
+					releases = append(releases, release)
+				}
+				m.Unlock()
+			}
+			adminReqs <- req
 		}
+		close(adminReqs)
 	}()
 
-	if isShell {
-		s.startShell(channel, newReqs)
-	} else {
-		var exit struct {
-			Code int
-		}
-		exit.Code = s.execCmd(channel, newReqs, cmd.Line)
-		channel.SendRequest("exit-status", false, ssh.Marshal(exit))
+	s.log.Printf("Proxying session to node id %s\n", id)
+	proxyChannel(channel, adminReqs, nodeChannel, nodeReqs)
+	s.log.Printf("Session to node id %s closed\n", id)
+
+	m.Lock()
+	defer m.Unlock()
+	closed = true
+	for _, release := range releases {
+		release()
 	}
 }
 
-func (s *SshConnection) startShell(channel ssh.Channel, reqs <-chan *ssh.Request) {
-	NewTerminal(s.server, channel, reqs).Start()
+func (s *SshConnection) startShell(channel ssh.Channel, reqs *sessionRequests) {
+	NewTerminal(s, channel, reqs).Start()
 }
 
-func (s *SshConnection) execCmd(channel ssh.Channel, reqs <-chan *ssh.Request, cmd string) int {
+func (s *SshConnection) execCmd(channel ssh.Channel, reqs *sessionRequests, cmd string) domain.ExitStatus {
+	var status domain.ExitStatus
 	ctx := CmdContext{
-		channel,
-		s.log,
-		s.server,
-		nil,
+		Channel:  channel,
+		Log:      s.log,
+		Server:   s.server,
+		Identity: s.KeyFingerprint(),
+		Pty:      reqs.Pty(),
+		reqs:     reqs,
+		exit:     &status,
 	}
-	return commands.Exec(ctx, cmd)
+	if ctx.Pty != nil {
+		// Ctrl-C is typed in the terminal of the admin
+		ctx.Channel = ptyChannel{inputChannel{channel, newSessionInput(channel)}}
+	}
+	code := s.server.commands().Exec(ctx, cmd)
+	if status.Signal == "" {
+		status.Code = code
+	}
+	return status
+}
+
+// forwardChannel relays a channel opened by a node, for agent or X11
+// forwarding, to the admin on this connection.
+func (s *SshConnection) forwardChannel(newChan ssh.NewChannel) {
+	channel, reqs, err := s.conn.OpenChannel(newChan.ChannelType(), newChan.ExtraData())
+	if err != nil {
+		s.log.Printf("Error opening `%s` channel: %s\n", newChan.ChannelType(), err)
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	nodeChannel, nodeReqs, err := newChan.Accept()
+	if err != nil {
+		channel.Close()
+		s.log.Printf("Error accepting `%s` channel: %s\n", newChan.ChannelType(), err)
+		return
+	}
+
+	proxyChannel(nodeChannel, nodeReqs, channel, reqs)
 }
 
 func (s *SshConnection) rejectNewChannelWithError(newChan ssh.NewChannel, reason ssh.RejectionReason, code SshError, err error) {
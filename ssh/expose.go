@@ -0,0 +1,343 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/fsutil"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exposure is a brain listener forwarding its connections to a device port.
+type Exposure struct {
+	Listen string
+	Device string
+	Port   uint32
+	Udp    bool `json:",omitempty"`
+}
+
+// Key identifies the exposure among the others, e.g. `:8161/udp`.
+func (e Exposure) Key() string {
+	if e.Udp {
+		return e.Listen + "/udp"
+	}
+	return e.Listen
+}
+
+type exposure struct {
+	Exposure
+	listener io.Closer
+}
+
+// RestoreExposures loads the exposures saved in path, opens their listeners
+// and saves the following changes to it.
+func (s *SshServer) RestoreExposures(path string) error {
+	var saved []Exposure
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("Invalid exposures %s: %s", path, err)
+		}
+	}
+
+	for _, e := range saved {
+		if err := s.Expose(e); err != nil {
+			log.Printf("Error restoring exposure of %s:%d on %s: %s\n", e.Device, e.Port, e.Key(), err)
+		}
+	}
+	s.a.Run(func() {
+		s.exposuresPath = path
+	})
+	return nil
+}
+
+// Expose opens a TCP listener on the brain forwarding each connection to a
+// port of a device. The device doesn't need to be connected yet.
+func (s *SshServer) Expose(e Exposure) (err error) {
+	e.Device = strings.ToUpper(e.Device)
+	s.a.Run(func() {
+		if _, exists := s.exposures[e.Key()]; exists {
+			err = fmt.Errorf("%s is already exposed", e.Key())
+			return
+		}
+
+		if e.Udp {
+			var pc net.PacketConn
+			if pc, err = net.ListenPacket("udp", e.Listen); err != nil {
+				return
+			}
+			s.exposures[e.Key()] = &exposure{e, pc}
+			go s.relayExposedUdp(e, pc)
+		} else {
+			var l net.Listener
+			if l, err = net.Listen("tcp", e.Listen); err != nil {
+				return
+			}
+			s.exposures[e.Key()] = &exposure{e, l}
+			go s.acceptExposed(e, l)
+		}
+		if err = s.saveExposures(); err != nil {
+			// it wouldn't be restored
+			s.exposures[e.Key()].listener.Close()
+			delete(s.exposures, e.Key())
+		}
+	})
+	return
+}
+
+// Unexpose closes the listener with the key addr, e.g. `:8080` or `:8161/udp`.
+func (s *SshServer) Unexpose(addr string) (err error) {
+	s.a.Run(func() {
+		e, exists := s.exposures[addr]
+		if !exists {
+			err = fmt.Errorf("%s is not exposed", addr)
+			return
+		}
+		delete(s.exposures, addr)
+		e.listener.Close()
+		err = s.saveExposures()
+	})
+	return
+}
+
+// Exposures returns the exposures sorted by listen address.
+func (s *SshServer) Exposures() []Exposure {
+	var list []Exposure
+	s.a.Run(func() {
+		list = make([]Exposure, 0, len(s.exposures))
+		for _, e := range s.exposures {
+			list = append(list, e.Exposure)
+		}
+	})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key() < list[j].Key()
+	})
+	return list
+}
+
+// saveExposures must be called from the server actor.
+func (s *SshServer) saveExposures() error {
+	if s.exposuresPath == "" {
+		return nil
+	}
+	list := make([]Exposure, 0, len(s.exposures))
+	for _, e := range s.exposures {
+		list = append(list, e.Exposure)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(s.exposuresPath, data, 0600)
+}
+
+func (s *SshServer) acceptExposed(e Exposure, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("Stopped exposing %s:%d on %s: %s\n", e.Device, e.Port, e.Listen, err)
+			return
+		}
+		go s.forwardExposed(e, conn)
+	}
+}
+
+func (s *SshServer) forwardExposed(e Exposure, conn net.Conn) {
+	node := s.exposedNode(e, conn.RemoteAddr())
+	if node == nil {
+		conn.Close()
+		return
+	}
+
+	remote, err := node.Dial("127.0.0.1", e.Port)
+	if err != nil {
+		node.log.Printf("Error dialing exposed port %d for %s: %s\n", e.Port, conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	node.log.Printf("Forwarding %s from %s to port %d\n", e.Listen, conn.RemoteAddr(), e.Port)
+	splice(conn, remote)
+}
+
+func (s *SshServer) exposedNode(e Exposure, from net.Addr) *Node {
+	node := s.getNode(e.Device)
+	if node == nil {
+		log.Printf("[%s] Exposed device %s is not connected\n", from, e.Device)
+	}
+	return node
+}
+
+// UdpQueuedDatagrams is how many datagrams of a source address wait for its
+// UDP channel, the following ones are dropped.
+var UdpQueuedDatagrams = 64
+
+// relayExposedUdp forwards the datagrams received on pc to the device, using
+// a UDP channel per source address which closes after UdpIdleTimeout.
+func (s *SshServer) relayExposedUdp(e Exposure, pc net.PacketConn) {
+	var m sync.Mutex
+	associations := make(map[string]*udpAssociation)
+	stopped := make(chan struct{})
+	buf := make([]byte, MaxDatagramSize)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Stopped exposing %s:%d on %s: %s\n", e.Device, e.Port, e.Key(), err)
+			close(stopped)
+			return
+		}
+
+		m.Lock()
+		a := associations[from.String()]
+		if a == nil {
+			a = &udpAssociation{datagrams: make(chan []byte, UdpQueuedDatagrams)}
+			associations[from.String()] = a
+			go func(from net.Addr) {
+				s.forwardExposedUdp(e, pc, from, a, stopped)
+				m.Lock()
+				delete(associations, from.String())
+				m.Unlock()
+			}(from)
+		}
+		m.Unlock()
+
+		select {
+		case a.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+			// the device is slow or still being dialed
+		}
+	}
+}
+
+// udpAssociation queues the datagrams of a source address for its UDP channel.
+type udpAssociation struct {
+	datagrams chan []byte
+}
+
+// forwardExposedUdp dials a UDP channel to the device and relays the
+// datagrams of a until it's idle for UdpIdleTimeout or the relay is stopped.
+func (s *SshServer) forwardExposedUdp(e Exposure, pc net.PacketConn, from net.Addr, a *udpAssociation, stopped <-chan struct{}) {
+	node := s.exposedNode(e, from)
+	if node == nil {
+		return
+	}
+	channel, err := node.DialUDP("127.0.0.1", e.Port)
+	if err != nil {
+		node.log.Printf("Error dialing exposed UDP port %d for %s: %s\n", e.Port, from, err)
+		return
+	}
+	node.log.Printf("Forwarding %s from %s to UDP port %d\n", e.Key(), from, e.Port)
+	defer channel.Close()
+	idle := time.AfterFunc(UdpIdleTimeout, func() { channel.Close() })
+	defer idle.Stop()
+
+	replied := make(chan struct{})
+	go func() {
+		defer close(replied)
+		defer channel.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, err := channel.Read(buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(UdpIdleTimeout)
+			if _, err := pc.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case datagram := <-a.datagrams:
+			idle.Reset(UdpIdleTimeout)
+			if _, err := channel.Write(datagram); err != nil {
+				return
+			}
+		case <-replied:
+			return
+		case <-stopped:
+			return
+		}
+	}
+}
+
+// listenAddress turns a brain port into a listen address on the loopback, so
+// listening on other interfaces takes an explicit address like `:8080` or
+// `0.0.0.0:8080`. A `/udp` suffix selects UDP.
+func listenAddress(arg string) (addr string, udp bool, err error) {
+	if strings.HasSuffix(arg, "/udp") {
+		arg, udp = strings.TrimSuffix(arg, "/udp"), true
+	}
+	if _, err := strconv.ParseUint(arg, 10, 16); err == nil {
+		return net.JoinHostPort("127.0.0.1", arg), udp, nil
+	}
+	if _, _, err := net.SplitHostPort(arg); err != nil {
+		return "", false, fmt.Errorf("Invalid listen address %s", arg)
+	}
+	return arg, udp, nil
+}
+
+// exposeCommand lists exposures or adds one with
+// `expose <device-id>:<port>[/udp] on <brain-port|address>`.
+func exposeCommand(ctx CmdContext, args Arguments) int {
+	if len(args) == 0 {
+		fmt.Fprint(ctx, "Listen\tDevice\tPort\tConnected\n")
+		for _, e := range ctx.Server.Exposures() {
+			node, _ := ctx.Server.GetById(e.Device)
+			fmt.Fprintf(ctx, "%s\t%s\t%s\t%t\n", e.Key(), e.Device, portString(e.Port, e.Udp), node != nil)
+		}
+		return 0
+	}
+
+	if len(args) != 3 || args[1] != "on" {
+		return ctx.Usage("Expected <device-id>:<port>[/udp] on <brain-port|address>")
+	}
+	target := args[0]
+	udp := strings.HasSuffix(target, "/udp")
+	target = strings.TrimSuffix(target, "/udp")
+	sep := strings.LastIndexByte(target, ':')
+	if sep <= 0 {
+		return ctx.Usage("Invalid device port %s", args[0])
+	}
+	port, err := strconv.ParseUint(target[sep+1:], 10, 16)
+	if err != nil {
+		return ctx.Usage("Invalid port %s", target[sep+1:])
+	}
+	addr, udpListen, err := listenAddress(args[2])
+	if err != nil {
+		return ctx.Usage("%s", err)
+	}
+
+	e := Exposure{Listen: addr, Device: target[:sep], Port: uint32(port), Udp: udp || udpListen}
+	if err := ctx.Server.Expose(e); err != nil {
+		fmt.Fprintf(ctx.Stderr(), "Error exposing %s on %s: %s\n", args[0], e.Key(), err)
+		return 1
+	}
+	ctx.Log.Printf("%s exposed on %s by %s\n", args[0], e.Key(), ctx.Identity)
+	return 0
+}
+
+func unexposeCommand(ctx CmdContext, args Arguments) int {
+	addr, udp, err := listenAddress(args[0])
+	if err != nil {
+		return ctx.Usage("%s", err)
+	}
+	key := Exposure{Listen: addr, Udp: udp}.Key()
+	if err := ctx.Server.Unexpose(key); err != nil {
+		fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+		return 1
+	}
+	ctx.Log.Printf("%s unexposed by %s\n", key, ctx.Identity)
+	return 0
+}
@@ -0,0 +1,247 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// filters process the output of brain commands in pipelines. They read their
+// input from ctx and write their output to it, like commands.
+var filters Cmds
+
+func init() {
+	filters = Cmds{
+		"grep": Cmd{Description: "Keep the lines matching a regular expression", Flags: []Flag{
+			{Name: "-v", Desc: "Keep the lines not matching instead"},
+			{Name: "-i", Desc: "Ignore case"},
+			{Name: "-H", Desc: "Keep the first line, the header of tables"},
+		}, Args: []Arg{
+			{Name: "pattern"},
+		}, Handler: grepFilter},
+		"sort": Cmd{Description: "Sort the lines", Flags: []Flag{
+			{Name: "-r", Desc: "Reverse the order"},
+			{Name: "-n", Desc: "Compare as numbers"},
+			{Name: "-k", Value: "column", Desc: "Compare the tab separated column, starting at 1"},
+			{Name: "-H", Desc: "Keep the first line, the header of tables, first"},
+		}, Handler: sortFilter},
+		"head": Cmd{Description: "Keep the first lines", Flags: []Flag{
+			{Name: "-n", Value: "lines", Desc: "Number of lines to keep, 10 by default"},
+		}, Handler: headFilter},
+		"json": Cmd{Description: "Convert a table to a JSON array of objects keyed by its header", Handler: jsonFilter},
+	}
+}
+
+// runPipeline runs the stages of a pipeline connected by pipes. Like with
+// `set -o pipefail`, the exit code is the last non-zero one.
+func runPipeline(ctx CmdContext, invs []*invocation) int {
+	codes := make([]int, len(invs))
+	var wg sync.WaitGroup
+	var stdin io.Reader = ctx.Channel
+	for i, inv := range invs {
+		var out io.Writer = ctx.Channel
+		var next *io.PipeReader
+		var w *io.PipeWriter
+		if i < len(invs)-1 {
+			next, w = io.Pipe()
+			out = w
+		}
+		inv.ctx.Channel = pipeChannel{stdin, out, ctx.Stderr()}
+
+		wg.Add(1)
+		go func(i int, inv *invocation, in io.Reader, w *io.PipeWriter) {
+			defer wg.Done()
+			codes[i] = inv.run()
+			if w != nil {
+				w.Close()
+			}
+			// the previous stage fails writing once this one is done, like
+			// with SIGPIPE
+			if r, ok := in.(*io.PipeReader); ok {
+				r.Close()
+			}
+		}(i, inv, stdin, w)
+		stdin = next
+	}
+	wg.Wait()
+
+	code := 0
+	for _, c := range codes {
+		if c != 0 {
+			code = c
+		}
+	}
+	return code
+}
+
+// filterLines calls fn for each line read by a filter, without its line
+// ending, until fn returns false.
+func filterLines(ctx CmdContext, fn func(line string) bool) error {
+	scanner := bufio.NewScanner(ctx)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if !fn(strings.TrimSuffix(scanner.Text(), "\r")) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func filterError(ctx CmdContext, err error) int {
+	fmt.Fprintf(ctx.Stderr(), "%s: %s\n", ctx.name, err)
+	return 1
+}
+
+func grepFilter(ctx CmdContext, args Arguments) int {
+	pattern := args[0]
+	if ctx.Flags.Has("-i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return ctx.Usage("Invalid pattern: %s", err)
+	}
+
+	invert := ctx.Flags.Has("-v")
+	header := ctx.Flags.Has("-H")
+	matched := false
+	err = filterLines(ctx, func(line string) bool {
+		if header {
+			header = false
+		} else if re.MatchString(line) == invert {
+			return true
+		} else {
+			matched = true
+		}
+		_, err := fmt.Fprintf(ctx, "%s\n", line)
+		return err == nil
+	})
+	if err != nil {
+		return filterError(ctx, err)
+	} else if !matched {
+		return 1
+	}
+	return 0
+}
+
+func sortFilter(ctx CmdContext, args Arguments) int {
+	column := 0
+	if ctx.Flags.Has("-k") {
+		k, err := strconv.Atoi(ctx.Flags.Get("-k"))
+		if err != nil || k < 1 {
+			return ctx.Usage("Invalid column %s", ctx.Flags.Get("-k"))
+		}
+		column = k
+	}
+
+	var lines []string
+	if err := filterLines(ctx, func(line string) bool {
+		lines = append(lines, line)
+		return true
+	}); err != nil {
+		return filterError(ctx, err)
+	}
+
+	rows := lines
+	if ctx.Flags.Has("-H") && len(rows) > 0 {
+		fmt.Fprintf(ctx, "%s\n", rows[0])
+		rows = rows[1:]
+	}
+
+	key := func(line string) string {
+		if column == 0 {
+			return line
+		}
+		fields := strings.Split(line, "\t")
+		if column > len(fields) {
+			return ""
+		}
+		return fields[column-1]
+	}
+	numeric := ctx.Flags.Has("-n")
+	less := func(i, j int) bool {
+		a, b := key(rows[i]), key(rows[j])
+		if numeric {
+			x, _ := strconv.ParseFloat(strings.TrimSpace(a), 64)
+			y, _ := strconv.ParseFloat(strings.TrimSpace(b), 64)
+			return x < y
+		}
+		return a < b
+	}
+	if ctx.Flags.Has("-r") {
+		sort.SliceStable(rows, func(i, j int) bool { return less(j, i) })
+	} else {
+		sort.SliceStable(rows, less)
+	}
+
+	for _, line := range rows {
+		if _, err := fmt.Fprintf(ctx, "%s\n", line); err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+func headFilter(ctx CmdContext, args Arguments) int {
+	count := 10
+	if ctx.Flags.Has("-n") {
+		n, err := strconv.Atoi(ctx.Flags.Get("-n"))
+		if err != nil || n < 0 {
+			return ctx.Usage("Invalid line count %s", ctx.Flags.Get("-n"))
+		}
+		count = n
+	}
+
+	if count == 0 {
+		return 0
+	}
+	err := filterLines(ctx, func(line string) bool {
+		_, err := fmt.Fprintf(ctx, "%s\n", line)
+		count--
+		return err == nil && count > 0
+	})
+	if err != nil {
+		return filterError(ctx, err)
+	}
+	return 0
+}
+
+// jsonFilter converts the tab separated table printed by most commands, its
+// first line naming the columns.
+func jsonFilter(ctx CmdContext, args Arguments) int {
+	var header []string
+	rows := make([]map[string]string, 0)
+	err := filterLines(ctx, func(line string) bool {
+		fields := strings.Split(line, "\t")
+		if header == nil {
+			header = fields
+			return true
+		}
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(fields) {
+				row[name] = fields[i]
+			} else {
+				row[name] = ""
+			}
+		}
+		rows = append(rows, row)
+		return true
+	})
+	if err != nil {
+		return filterError(ctx, err)
+	}
+
+	data, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return filterError(ctx, err)
+	}
+	fmt.Fprintf(ctx, "%s\n", data)
+	return 0
+}
@@ -0,0 +1,182 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/fsutil"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxHistory is the number of commands kept in the history of an admin.
+var MaxHistory = 1000
+
+// historyStore keeps the commands typed by each admin in the brain shell, in
+// a file per admin key.
+type historyStore struct {
+	m   sync.Mutex
+	dir string
+}
+
+// SetHistoryDir keeps the shell history of each admin in dir.
+func (s *SshServer) SetHistoryDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	s.history = &historyStore{dir: dir}
+	return nil
+}
+
+func (h *historyStore) path(identity string) string {
+	name := strings.NewReplacer("/", "_", "+", "-", ":", "_").Replace(identity)
+	return filepath.Join(h.dir, name)
+}
+
+// Load returns the history of an admin, oldest first.
+func (h *historyStore) Load(identity string) ([]string, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.load(identity)
+}
+
+func (h *historyStore) load(identity string) ([]string, error) {
+	f, err := os.Open(h.path(identity))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) > MaxHistory {
+		lines = lines[len(lines)-MaxHistory:]
+	}
+	return lines, scanner.Err()
+}
+
+// Add appends a line to the history of an admin. The file is trimmed to
+// MaxHistory lines when it grows large.
+func (h *historyStore) Add(identity, line string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	f, err := os.OpenFile(h.path(identity), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(h.path(identity)); err == nil && info.Size() > int64(MaxHistory)*80 {
+		return h.trim(identity)
+	}
+	return nil
+}
+
+func (h *historyStore) trim(identity string) error {
+	lines, err := h.load(identity)
+	if err != nil || len(lines) < MaxHistory {
+		return err
+	}
+	data := strings.Join(lines, "\n") + "\n"
+	return fsutil.WriteFileAtomic(h.path(identity), []byte(data), 0600)
+}
+
+// Clear removes the history of an admin.
+func (h *historyStore) Clear(identity string) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err := os.Remove(h.path(identity)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// seededChannel replays saved lines to a new terminal, without echoing them,
+// so they are in its history before the admin types anything.
+type seededChannel struct {
+	io.ReadWriter
+	seed  []byte
+	muted bool
+}
+
+func (c *seededChannel) Read(b []byte) (int, error) {
+	if len(c.seed) > 0 {
+		n := copy(b, c.seed)
+		c.seed = c.seed[n:]
+		return n, nil
+	}
+	return c.ReadWriter.Read(b)
+}
+
+func (c *seededChannel) Write(b []byte) (int, error) {
+	if c.muted {
+		return len(b), nil
+	}
+	return c.ReadWriter.Write(b)
+}
+
+// replayable tells if a saved line can be replayed as keystrokes.
+func replayable(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	for _, r := range line {
+		if r < ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func historyCommand(ctx CmdContext, args Arguments) int {
+	history := ctx.Server.history
+	if history == nil {
+		fmt.Fprintln(ctx.Stderr(), "History not configured")
+		return 1
+	}
+
+	if ctx.Flags.Has("-c") {
+		if err := history.Clear(ctx.Identity); err != nil {
+			fmt.Fprintf(ctx.Stderr(), "Error clearing history: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	lines, err := history.Load(ctx.Identity)
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr(), "Error reading history: %s\n", err)
+		return 1
+	}
+	first := 0
+	if ctx.Flags.Has("-n") {
+		n, err := strconv.Atoi(ctx.Flags.Get("-n"))
+		if err != nil || n < 0 {
+			return ctx.Usage("Invalid line count %s", ctx.Flags.Get("-n"))
+		}
+		if n < len(lines) {
+			first = len(lines) - n
+		}
+	}
+	for i := first; i < len(lines); i++ {
+		if len(args) == 0 || strings.Contains(lines[i], args[0]) {
+			fmt.Fprintf(ctx, "%5d  %s\n", i+1, lines[i])
+		}
+	}
+	return 0
+}
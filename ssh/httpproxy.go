@@ -0,0 +1,225 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HttpProxy is a service letting devices reach upstream HTTP endpoints through
+// the brain. Requests with a relative URL, e.g. `wget http://127.0.0.1:8080/fw.bin`
+// through `ssh -L 8080:firmware:0 brain`, go to Upstream. Devices can also use
+// the service as their http_proxy to reach absolute URLs, and https URLs with
+// CONNECT, as long as they are allowed.
+type HttpProxy struct {
+	Upstream *url.URL
+	// Allow lists the URL prefixes devices can reach in addition to Upstream.
+	Allow []string
+
+	proxy *httputil.ReverseProxy
+}
+
+func NewHttpProxy(upstream *url.URL, allow []string) *HttpProxy {
+	p := &HttpProxy{
+		Upstream: upstream,
+		Allow:    allow,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = p.target(req)
+			req.Host = req.URL.Host
+		},
+	}
+	return p
+}
+
+// Handle serves HTTP on a device connection, use it as a Service handler.
+func (p *HttpProxy) Handle(client *SshConnection, conn net.Conn) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			p.serveHTTP(client, w, req)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	server.Serve(newConnListener(conn))
+}
+
+func (p *HttpProxy) serveHTTP(client *SshConnection, w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodConnect {
+		p.connect(client, w, req)
+		return
+	}
+
+	target := p.target(req)
+	if !p.allowed(target) {
+		client.log.Printf("HTTP proxy refused %s %s\n", req.Method, target)
+		http.Error(w, "Forbidden by the brain", http.StatusForbidden)
+		return
+	}
+
+	client.log.Printf("HTTP proxy %s %s\n", req.Method, target)
+	p.proxy.ServeHTTP(w, req)
+}
+
+// connect opens a tunnel to an https host having an allowed URL prefix.
+func (p *HttpProxy) connect(client *SshConnection, w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	if !p.allowedHost(host) {
+		client.log.Printf("HTTP proxy refused CONNECT %s\n", host)
+		http.Error(w, "Forbidden by the brain", http.StatusForbidden)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", host, 30*time.Second)
+	if err != nil {
+		client.log.Printf("HTTP proxy error connecting to %s: %s\n", host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+
+	client.log.Printf("HTTP proxy CONNECT %s\n", host)
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if buf.Reader.Buffered() > 0 {
+		io.CopyN(upstream, buf, int64(buf.Reader.Buffered()))
+	}
+	splice(conn, upstream)
+}
+
+func (p *HttpProxy) target(req *http.Request) *url.URL {
+	if req.URL.IsAbs() {
+		return req.URL
+	}
+	u := *p.Upstream
+	u.Path = strings.TrimSuffix(p.Upstream.Path, "/") + req.URL.Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+	return &u
+}
+
+// allowed checks the target against Upstream and the allowed prefixes.
+func (p *HttpProxy) allowed(target *url.URL) bool {
+	clean := path.Clean("/" + target.Path)
+	if strings.HasSuffix(target.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+
+	for _, allowed := range p.prefixes() {
+		if allowed.Scheme == target.Scheme && canonicalHost(allowed) == canonicalHost(target) && withinPath(clean, allowed.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedHost tells if an https host is part of any allowed prefix, which is
+// all that can be checked for CONNECT.
+func (p *HttpProxy) allowedHost(host string) bool {
+	target := &url.URL{Scheme: "https", Host: host}
+	for _, allowed := range p.prefixes() {
+		if allowed.Scheme == "https" && canonicalHost(allowed) == canonicalHost(target) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinPath tells if p is prefix or a path below it, `/repo` allowing `/repo/x`
+// but not `/repository`.
+func withinPath(p, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func (p *HttpProxy) prefixes() []*url.URL {
+	prefixes := []*url.URL{p.Upstream}
+	for _, prefix := range p.Allow {
+		if u, err := url.Parse(prefix); err == nil {
+			prefixes = append(prefixes, u)
+		}
+	}
+	return prefixes
+}
+
+// canonicalHost returns the host of u with its port.
+func canonicalHost(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(host, "443")
+	}
+	return net.JoinHostPort(host, "80")
+}
+
+// connListener is a net.Listener accepting a single connection, used to
+// serve a protocol on a service connection.
+type connListener struct {
+	m      sync.Mutex
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		closed: make(chan struct{}),
+	}
+	l.conn = &listenedConn{conn, l}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.m.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.m.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// listenedConn closes its listener when closed.
+type listenedConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *listenedConn) Close() error {
+	c.l.Close()
+	return c.Conn.Close()
+}
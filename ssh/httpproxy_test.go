@@ -0,0 +1,160 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestWithinPath(t *testing.T) {
+	tests := []struct {
+		p, prefix string
+		within    bool
+	}{
+		{"/repo", "/repo", true},
+		{"/repo/", "/repo", true},
+		{"/repo/fw.bin", "/repo", true},
+		{"/repo/a/b", "/repo/", true},
+		{"/repo", "/repo/", true},
+		{"/repository", "/repo", false},
+		{"/repository", "/repo/", false},
+		{"/rep", "/repo", false},
+		{"/", "/repo", false},
+		{"/anything", "", true},
+		{"/anything", "/", true},
+	}
+	for _, test := range tests {
+		if within := withinPath(test.p, test.prefix); within != test.within {
+			t.Errorf("withinPath(%q, %q) = %t, want %t", test.p, test.prefix, within, test.within)
+		}
+	}
+}
+
+func testProxy(t *testing.T, upstream string) *HttpProxy {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewHttpProxy(u, []string{"https://Mirror.example:8443/pub/", "http://other.example", "::invalid"})
+}
+
+func TestHttpProxyAllowed(t *testing.T) {
+	p := testProxy(t, "http://firmware.example/repo")
+	tests := []struct {
+		target  string
+		allowed bool
+	}{
+		{"http://firmware.example/repo", true},
+		{"http://firmware.example/repo/fw.bin", true},
+		{"http://firmware.example:80/repo/fw.bin", true},
+		{"http://FIRMWARE.example/repo/fw.bin", true},
+		{"http://firmware.example/./repo//fw.bin", true},
+		{"http://firmware.example/repository", false},
+		{"http://firmware.example/", false},
+		{"http://firmware.example/repo/../secret", false},
+		{"http://firmware.example/repo/%2e%2e/secret", false},
+		{"http://firmware.example/repo/%2E%2E/%2e%2e/etc/passwd", false},
+		{"http://firmware.example:8080/repo/fw.bin", false},
+		{"https://firmware.example/repo/fw.bin", false},
+		{"http://firmware.example.evil/repo/fw.bin", false},
+		{"https://mirror.example:8443/pub/a.tgz", true},
+		{"https://mirror.example:8443/pub", true},
+		{"https://mirror.example:8443/public", false},
+		{"https://mirror.example/pub/a.tgz", false},
+		{"http://mirror.example:8443/pub/a.tgz", false},
+		{"http://other.example/anything", true},
+		{"http://other.example:81/anything", false},
+	}
+	for _, test := range tests {
+		target, err := url.Parse(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := p.allowed(target); allowed != test.allowed {
+			t.Errorf("allowed(%s) = %t, want %t", test.target, allowed, test.allowed)
+		}
+	}
+}
+
+func TestHttpProxyAllowedHost(t *testing.T) {
+	p := testProxy(t, "http://firmware.example/repo")
+	tests := []struct {
+		host    string
+		allowed bool
+	}{
+		{"mirror.example:8443", true},
+		{"MIRROR.example:8443", true},
+		{"mirror.example:443", false},
+		{"firmware.example:443", false},
+		{"firmware.example:80", false},
+		{"other.example:443", false},
+		{"evil.example:8443", false},
+	}
+	for _, test := range tests {
+		if allowed := p.allowedHost(test.host); allowed != test.allowed {
+			t.Errorf("allowedHost(%s) = %t, want %t", test.host, allowed, test.allowed)
+		}
+	}
+}
+
+func TestHttpProxyRoundTrip(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, "upstream "+req.URL.Path)
+	}))
+	defer upstream.Close()
+	p := testProxy(t, upstream.URL+"/repo")
+	client := &SshConnection{log: log.New(ioutil.Discard, "", 0)}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p.serveHTTP(client, w, req)
+	}))
+	defer proxy.Close()
+
+	host := upstream.Listener.Addr().String()
+	tests := []struct {
+		request string
+		status  int
+		body    string
+	}{
+		{"GET /fw.bin HTTP/1.1\r\nHost: brain\r\n", http.StatusOK, "upstream /repo/fw.bin"},
+		{"GET http://" + host + "/repo/fw.bin HTTP/1.1\r\nHost: " + host + "\r\n", http.StatusOK, "upstream /repo/fw.bin"},
+		{"GET http://" + host + "/repository HTTP/1.1\r\nHost: " + host + "\r\n", http.StatusForbidden, ""},
+		{"GET http://" + host + "/repo/%2e%2e/secret HTTP/1.1\r\nHost: " + host + "\r\n", http.StatusForbidden, ""},
+		{"GET http://evil.example/repo/fw.bin HTTP/1.1\r\nHost: evil.example\r\n", http.StatusForbidden, ""},
+		// the upstream is plain http, so it can't be reached with CONNECT
+		{"CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n", http.StatusForbidden, ""},
+		{"CONNECT evil.example:443 HTTP/1.1\r\nHost: evil.example:443\r\n", http.StatusForbidden, ""},
+	}
+	for _, test := range tests {
+		status, body := proxyRequest(t, proxy.Listener.Addr().String(), test.request)
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("%q = %d %q, want %d %q", test.request, status, body, test.status, test.body)
+		}
+	}
+}
+
+// proxyRequest sends a raw request, without its final empty line, to the proxy
+// at addr.
+func proxyRequest(t *testing.T, addr, request string) (status int, body string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, request+"Connection: close\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
@@ -0,0 +1,166 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"sync"
+)
+
+// keyCtrlC interrupts the brain command being run from a terminal.
+const keyCtrlC = 3
+
+// MaxPendingInput is the number of bytes of input buffered before the session
+// stops reading it. While a command can be interrupted, input is still read to
+// see Ctrl-C and the keys typed ahead beyond this are dropped.
+var MaxPendingInput = 64 * 1024
+
+// sessionInput reads the input of an admin session with a pty in the
+// background, so Ctrl-C interrupts a brain command even when it doesn't read
+// its input. Keys typed meanwhile are kept for the next reader.
+type sessionInput struct {
+	m         sync.Mutex
+	interrupt func()
+	buf       []byte
+	err       error
+	// closed and replaced when data or an error arrives
+	ready chan struct{}
+	// signaled when buf is consumed or interrupt changes
+	space *sync.Cond
+}
+
+func newSessionInput(r io.Reader) *sessionInput {
+	in := &sessionInput{ready: make(chan struct{})}
+	in.space = sync.NewCond(&in.m)
+	go in.readLoop(r)
+	return in
+}
+
+// readLoop stops reading while the buffer is full, so the flow control of the
+// channel slows down the admin, unless Ctrl-C has to be seen.
+func (in *sessionInput) readLoop(r io.Reader) {
+	b := make([]byte, 1024)
+	for {
+		in.m.Lock()
+		for len(in.buf) >= MaxPendingInput && in.interrupt == nil {
+			in.space.Wait()
+		}
+		in.m.Unlock()
+
+		n, err := r.Read(b)
+		chunk := b[:n]
+
+		in.m.Lock()
+		if in.interrupt != nil {
+			if bytes.IndexByte(chunk, keyCtrlC) != -1 {
+				in.interrupt()
+				chunk = bytes.Replace(chunk, []byte{keyCtrlC}, nil, -1)
+			}
+			if room := MaxPendingInput - len(in.buf); len(chunk) > room {
+				chunk = chunk[:max(room, 0)]
+			}
+		}
+		in.buf = append(in.buf, chunk...)
+		if err != nil {
+			in.err = err
+		}
+		close(in.ready)
+		in.ready = make(chan struct{})
+		in.m.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (in *sessionInput) Read(b []byte) (int, error) {
+	return in.readUntil(b, nil)
+}
+
+// readUntil reads like Read until stop is closed, then returns io.EOF without
+// consuming more input.
+func (in *sessionInput) readUntil(b []byte, stop <-chan struct{}) (int, error) {
+	for {
+		in.m.Lock()
+		if len(in.buf) > 0 {
+			n := copy(b, in.buf)
+			in.buf = in.buf[n:]
+			in.space.Signal()
+			in.m.Unlock()
+			return n, nil
+		} else if in.err != nil {
+			in.m.Unlock()
+			return 0, in.err
+		}
+		ready := in.ready
+		in.m.Unlock()
+
+		select {
+		case <-ready:
+		case <-stop:
+			return 0, io.EOF
+		}
+	}
+}
+
+// interruptWith makes Ctrl-C call cb, or pass through to readers when cb is
+// nil, until the returned function is called.
+func (in *sessionInput) interruptWith(cb func()) (restore func()) {
+	in.m.Lock()
+	defer in.m.Unlock()
+	previous := in.interrupt
+	in.interrupt = cb
+	in.space.Signal()
+	return func() {
+		in.m.Lock()
+		defer in.m.Unlock()
+		in.interrupt = previous
+		in.space.Signal()
+	}
+}
+
+// inputChannel is a session channel read through its sessionInput.
+type inputChannel struct {
+	ssh.Channel
+	input *sessionInput
+}
+
+func (c inputChannel) Read(b []byte) (int, error) {
+	return c.input.Read(b)
+}
+
+// stoppableReader returns a reader of r which stops once stop is closed. Only
+// the input of a session can be stopped without consuming more of it, other
+// readers are returned as is with waitable false.
+func stoppableReader(r io.Reader, stop <-chan struct{}) (reader io.Reader, waitable bool) {
+	if c, ok := r.(inputChannel); ok {
+		return readerFunc(func(b []byte) (int, error) {
+			return c.input.readUntil(b, stop)
+		}), true
+	}
+	return r, false
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// closeOnDone closes c when ctx is done, until the returned function is
+// called.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+	}
+}
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestRawRelaysMoreThanPendingInput(t *testing.T) {
+	data := make([]byte, 4*MaxPendingInput+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	r, w := io.Pipe()
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+	in := newSessionInput(r)
+	ctx := CmdContext{Channel: ptyChannel{inputChannel{nil, in}}}
+
+	// the command waits before reading, like a device slower than the admin
+	for full := false; !full; time.Sleep(time.Millisecond) {
+		in.m.Lock()
+		full = len(in.buf) >= MaxPendingInput
+		in.m.Unlock()
+	}
+	raw, restore := ctx.Raw()
+	defer restore()
+	got, err := ioutil.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("relayed %d bytes, want the %d bytes sent", len(got), len(data))
+	}
+}
+
+func TestInterruptSeenWithFullInput(t *testing.T) {
+	r, w := io.Pipe()
+	in := newSessionInput(r)
+	interrupted := make(chan struct{})
+	restore := in.interruptWith(func() { close(interrupted) })
+	defer restore()
+
+	// nothing reads the input while the command runs
+	go func() {
+		w.Write(make([]byte, 2*MaxPendingInput))
+		w.Write([]byte{keyCtrlC})
+	}()
+	<-interrupted
+
+	in.m.Lock()
+	pending := len(in.buf)
+	in.m.Unlock()
+	if pending > MaxPendingInput {
+		t.Errorf("%d bytes pending, want at most %d", pending, MaxPendingInput)
+	}
+}
@@ -0,0 +1,252 @@
+package ssh
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobsRole lets an admin cancel the jobs of the other admins, everyone can
+// cancel their own.
+const JobsRole = "jobs"
+
+// MaxJobs is the number of ended background jobs kept for `jobs`.
+var MaxJobs = 100
+
+// MaxJobOutput is the number of bytes of output kept for each job, the oldest
+// are dropped.
+var MaxJobOutput = 1 << 20
+
+// job is a command line run in the background with `&`. It isn't tied to the
+// session which started it, so it survives the admin disconnecting.
+type job struct {
+	id       int
+	line     string
+	identity string
+	started  time.Time
+	cancel   context.CancelFunc
+	output   *jobOutput
+
+	// set through the actor of the server
+	ended     time.Time
+	code      int
+	cancelled bool
+}
+
+// jobInfo is a snapshot of a job.
+type jobInfo struct {
+	Id        int
+	Line      string
+	Identity  string
+	Started   time.Time
+	Ended     time.Time
+	Code      int
+	Cancelled bool
+}
+
+func (j jobInfo) State() string {
+	switch {
+	case j.Ended.IsZero():
+		return "running"
+	case j.Cancelled:
+		return "cancelled"
+	case j.Code == 0:
+		return "done"
+	default:
+		return fmt.Sprintf("exit %d", j.Code)
+	}
+}
+
+// jobOutput keeps the last MaxJobOutput bytes written by a job.
+type jobOutput struct {
+	m         sync.Mutex
+	data      []byte
+	truncated bool
+}
+
+func (o *jobOutput) Write(b []byte) (int, error) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.data = append(o.data, b...)
+	if over := len(o.data) - MaxJobOutput; over > 0 {
+		o.data = append(o.data[:0], o.data[over:]...)
+		o.truncated = true
+	}
+	return len(b), nil
+}
+
+func (o *jobOutput) Bytes() ([]byte, bool) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return append([]byte(nil), o.data...), o.truncated
+}
+
+// startJob runs checked invocations in the background, their output going to
+// the job.
+func (s *SshServer) startJob(ctx CmdContext, line string, invs []*invocation) int {
+	jobCtx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		line:     line,
+		identity: ctx.Identity,
+		started:  time.Now(),
+		cancel:   cancel,
+		output:   &jobOutput{},
+	}
+	s.a.Run(func() {
+		s.lastJobId++
+		j.id = s.lastJobId
+		s.jobs[j.id] = j
+	})
+
+	ctx.Channel = pipeChannel{strings.NewReader(""), j.output, stderrChannel{j.output}}
+	ctx.Pty, ctx.reqs, ctx.exit = nil, nil, nil
+	for _, inv := range invs {
+		inv.ctx.Channel = ctx.Channel
+		inv.ctx.Pty, inv.ctx.reqs, inv.ctx.exit = nil, nil, nil
+	}
+
+	ctx.Log.Printf("Job %d started: %s\n", j.id, line)
+	go func() {
+		code := runInvocations(jobCtx, ctx, invs)
+		cancel()
+		ctx.Log.Printf("Job %d exited with %d\n", j.id, code)
+		var info jobInfo
+		s.a.Run(func() {
+			j.ended, j.code = time.Now(), code
+			info = j.info()
+			s.pruneJobs()
+		})
+		s.Notify("", fmt.Sprintf("Job %d %s: %s", j.id, info.State(), line))
+	}()
+	return j.id
+}
+
+// pruneJobs forgets the oldest ended jobs beyond MaxJobs, it must be run by the
+// actor.
+func (s *SshServer) pruneJobs() {
+	var ended []int
+	for id, j := range s.jobs {
+		if !j.ended.IsZero() {
+			ended = append(ended, id)
+		}
+	}
+	sort.Ints(ended)
+	for len(ended) > MaxJobs {
+		delete(s.jobs, ended[0])
+		ended = ended[1:]
+	}
+}
+
+// jobList returns the jobs sorted by id.
+func (s *SshServer) jobList() (infos []jobInfo) {
+	s.a.Run(func() {
+		for _, j := range s.jobs {
+			infos = append(infos, j.info())
+		}
+	})
+	sort.Slice(infos, func(i, k int) bool {
+		return infos[i].Id < infos[k].Id
+	})
+	return
+}
+
+func (s *SshServer) job(id int) (j *job, info jobInfo, exists bool) {
+	s.a.Run(func() {
+		if j, exists = s.jobs[id]; exists {
+			info = j.info()
+		}
+	})
+	return
+}
+
+// cancelJob cancels a running job for the admin with identity.
+func (s *SshServer) cancelJob(id int, identity string) (err error) {
+	s.a.Run(func() {
+		j, exists := s.jobs[id]
+		if !exists {
+			err = fmt.Errorf("No job %d", id)
+		} else if j.identity != identity && !hasRole(s.roles[identity], JobsRole) {
+			err = fmt.Errorf("Job %d was started by another admin", id)
+		} else if !j.ended.IsZero() {
+			err = fmt.Errorf("Job %d already ended", id)
+		} else {
+			j.cancelled = true
+			j.cancel()
+		}
+	})
+	return
+}
+
+// info must be called by the actor of the server.
+func (j *job) info() jobInfo {
+	return jobInfo{
+		Id:        j.id,
+		Line:      j.line,
+		Identity:  j.identity,
+		Started:   j.started,
+		Ended:     j.ended,
+		Code:      j.code,
+		Cancelled: j.cancelled,
+	}
+}
+
+func jobsCommand(ctx CmdContext, args Arguments) int {
+	fmt.Fprint(ctx, "Id\tState\tStarted\tAdmin\tCommand\n")
+	for _, j := range ctx.Server.jobList() {
+		fmt.Fprintf(ctx, "%d\t%s\t%s\t%s\t%s\n", j.Id, j.State(), j.Started.UTC().Format(time.RFC3339), shortIdentity(j.Identity), j.Line)
+	}
+	return 0
+}
+
+func jobCommand(ctx CmdContext, args Arguments) int {
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return ctx.Usage("Invalid job id %s", args[0])
+	}
+
+	switch args[1] {
+	case "log":
+		j, info, exists := ctx.Server.job(id)
+		if !exists {
+			fmt.Fprintf(ctx.Stderr(), "No job %d\n", id)
+			return 1
+		}
+		output, truncated := j.output.Bytes()
+		if truncated {
+			fmt.Fprint(ctx.Stderr(), "[output truncated]\n")
+		}
+		ctx.Write(output)
+		if !info.Ended.IsZero() {
+			fmt.Fprintf(ctx.Stderr(), "[%d] %s\n", id, info.State())
+		}
+	case "cancel":
+		if err := ctx.Server.cancelJob(id, ctx.Identity); err != nil {
+			fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+			return 1
+		}
+	default:
+		return ctx.Usage("Unknown action %s", args[1])
+	}
+	return 0
+}
+
+// shortIdentity abbreviates a key fingerprint for tables.
+func shortIdentity(identity string) string {
+	identity = strings.TrimPrefix(identity, "SHA256:")
+	if len(identity) > 12 {
+		return identity[:12]
+	}
+	return identity
+}
+
+func completeJobs(t *TerminalSession, prefix string) []string {
+	var ids []string
+	for _, j := range t.server.jobList() {
+		ids = append(ids, strconv.Itoa(j.Id))
+	}
+	return matchPrefix(ids, prefix)
+}
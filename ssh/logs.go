@@ -0,0 +1,93 @@
+package ssh
+
+import (
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/logstore"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SyslogService returns a service handler storing the syslog messages sent by
+// devices, e.g. with `logread -r 127.0.0.1 5514 -p /var/run/logread.pid -t`
+// through `ssh -L 5514:syslog:0 brain`.
+func SyslogService(store *logstore.Store) ServiceCallback {
+	return func(client *SshConnection, conn net.Conn) {
+		defer conn.Close()
+		id := strings.ToUpper(client.User())
+		client.log.Printf("Receiving logs from %s\n", id)
+
+		err := logstore.ReadMessages(conn, func(raw string) {
+			msg := logstore.Parse(raw)
+			app := msg.App
+			if app == "" {
+				app = "-"
+			}
+			line := fmt.Sprintf("%s %s %s %s: %s", time.Now().UTC().Format(time.RFC3339), id, msg.Priority(), app, msg.Text)
+			if err := store.Append(id, line); err != nil {
+				client.log.Printf("Error storing logs of %s: %s\n", id, err)
+			}
+		})
+		if err != nil {
+			client.log.Printf("Error receiving logs from %s: %s\n", id, err)
+		}
+	}
+}
+
+// SetLogStore enables the logs command to show the logs received from devices.
+func (s *SshServer) SetLogStore(store *logstore.Store) {
+	s.logs = store
+}
+
+// logsCommand prints the last logs of a device and, with -f, the following
+// ones until interrupted.
+func logsCommand(ctx CmdContext, args Arguments) int {
+	store := ctx.Server.logs
+	if store == nil {
+		fmt.Fprintln(ctx.Stderr(), "Log store not configured")
+		return 1
+	}
+
+	follow := ctx.Flags.Has("-f")
+	count := 50
+	if ctx.Flags.Has("-n") {
+		n, err := strconv.Atoi(ctx.Flags.Get("-n"))
+		if err != nil || n < 0 {
+			return ctx.Usage("Invalid line count %s", ctx.Flags.Get("-n"))
+		}
+		count = n
+	}
+	id := args[0]
+
+	var lines <-chan string
+	if follow {
+		var cancel func()
+		lines, cancel = store.Follow(id)
+		defer cancel()
+	}
+
+	history, err := store.Tail(id, count)
+	if err != nil {
+		ctx.Log.Printf("Error reading logs of %s: %s\n", id, err)
+		fmt.Fprintf(ctx.Stderr(), "Error reading logs of %s\n", id)
+		return 1
+	}
+	for _, line := range history {
+		fmt.Fprintf(ctx, "%s\n", line)
+	}
+	if !follow {
+		return 0
+	}
+
+	for {
+		select {
+		case line := <-lines:
+			if _, err := fmt.Fprintf(ctx, "%s\n", line); err != nil {
+				return 0
+			}
+		case <-ctx.Context.Done():
+			return 0
+		}
+	}
+}
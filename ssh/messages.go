@@ -50,6 +50,48 @@ type TcpIpForwardRequest struct {
 	PortNumberToBind uint32
 }
 
+type SubsystemRequest struct {
+	Name string
+}
+
+type WindowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32 // pixels
+	Height  uint32 // pixels
+}
+
+type EnvRequest struct {
+	Name  string
+	Value string
+}
+
+type SignalRequest struct {
+	Signal string // signal name without the SIG prefix
+}
+
+type BreakRequest struct {
+	Length uint32 // milliseconds
+}
+
+type X11Request struct {
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	ScreenNumber     uint32
+}
+
+type ExitStatusRequest struct {
+	Status uint32
+}
+
+type ExitSignalRequest struct {
+	Signal     string // signal name without the SIG prefix
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
 func (r DirectTcpipOpenRequest) OriginatorAddr() (net.Addr, error) {
 	rAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", r.OriginatorIPAddress, r.OriginatorPort))
 	if err != nil {
@@ -10,20 +10,28 @@ import (
 	"time"
 )
 
+// HandshakeTimeout limits the time taken to open the reverse SSH connection
+// to a node.
+var HandshakeTimeout = 30 * time.Second
+
 type Node struct {
 	a            *actor.Actor
 	c            *SshConnection
 	t            time.Time
 	log          *log.Logger
 	activeClient *ssh.Client
+	// admins of the sessions which asked for agent or X11 forwarding, by
+	// channel type and session
+	forwards map[string]map[interface{}]*SshConnection
 }
 
 func NewNode(c *SshConnection) *Node {
 	return &Node{
-		a:   actor.NewActor(),
-		c:   c,
-		t:   time.Now(),
-		log: c.log,
+		a:        actor.NewActor(),
+		c:        c,
+		t:        time.Now(),
+		log:      c.log,
+		forwards: make(map[string]map[interface{}]*SshConnection),
 	}
 }
 
@@ -63,7 +71,24 @@ func (n *Node) NewSession(ch domain.Channel, pty *domain.PtyRequest) (sess domai
 		session.Stderr = ch.Stderr()
 		session.Stdout = ch
 
-		sess = Session{session}
+		sess = Session{session, n}
+	})
+	return
+}
+
+// OpenChannel opens a raw channel on the reverse SSH connection to the node.
+func (n *Node) OpenChannel(kind string, data []byte) (channel ssh.Channel, reqs <-chan *ssh.Request, err error) {
+	n.a.Run(func() {
+		var client *ssh.Client
+		client, err = n.getSshClient()
+		if err != nil {
+			return
+		}
+
+		channel, reqs, err = client.OpenChannel(kind, data)
+		if err != nil {
+			log.Println("client.OpenChannel: ", err)
+		}
 	})
 	return
 }
@@ -72,6 +97,10 @@ func (n *Node) Dial(addr string, port uint32) (net.Conn, error) {
 	return n.c.Dial(addr, port)
 }
 
+func (n *Node) DialUDP(addr string, port uint32) (net.Conn, error) {
+	return n.c.DialUDP(addr, port)
+}
+
 func (n *Node) getSshClient() (*ssh.Client, error) {
 	if n.activeClient != nil {
 		return n.activeClient, nil
@@ -91,12 +120,15 @@ func (n *Node) getSshClient() (*ssh.Client, error) {
 			}),
 		},
 	}
+	// a device not answering the handshake must not block the node forever
+	nConn.SetDeadline(time.Now().Add(HandshakeTimeout))
 	sConn, chans, reqs, err := ssh.NewClientConn(nConn, n.c.RemoteAddr(), config)
 	if err != nil {
 		defer nConn.Close()
 		log.Println("ssh.NewClientConn: ", err)
 		return nil, err
 	}
+	nConn.SetDeadline(time.Time{})
 
 	go func() {
 		err := sConn.Wait()
@@ -107,5 +139,53 @@ func (n *Node) getSshClient() (*ssh.Client, error) {
 	}()
 
 	n.activeClient = ssh.NewClient(sConn, chans, reqs)
+	for _, kind := range forwardedChannelTypes {
+		go n.routeForwardedChannels(kind, n.activeClient.HandleChannelOpen(kind))
+	}
 	return n.activeClient, nil
 }
+
+// setForwardTarget routes the channels of a kind opened by the node, like
+// auth-agent@openssh.com, to the admin of a session until release is called
+// when the session ends.
+func (n *Node) setForwardTarget(kind string, session interface{}, c *SshConnection) (release func()) {
+	n.a.Post(func() {
+		if n.forwards[kind] == nil {
+			n.forwards[kind] = make(map[interface{}]*SshConnection)
+		}
+		n.forwards[kind][session] = c
+	})
+	return func() {
+		n.a.Post(func() {
+			delete(n.forwards[kind], session)
+		})
+	}
+}
+
+// routeForwardedChannels routes the channels opened by the node to the admin
+// who asked for them. Channels don't tell which session they belong to, so
+// they are refused when admins of different connections forward the same
+// kind at once, rather than handing an admin's agent to another one.
+func (n *Node) routeForwardedChannels(kind string, chans <-chan ssh.NewChannel) {
+	for newChan := range chans {
+		targets := make(map[*SshConnection]bool)
+		n.a.Run(func() {
+			for _, c := range n.forwards[kind] {
+				targets[c] = true
+			}
+		})
+
+		switch len(targets) {
+		case 0:
+			n.log.Printf("Rejecting `%s` channel, no forwarding requested\n", kind)
+			newChan.Reject(ssh.Prohibited, "No forwarding requested")
+		case 1:
+			for target := range targets {
+				go target.forwardChannel(newChan)
+			}
+		default:
+			n.log.Printf("Rejecting `%s` channel, forwarding requested by %d admins\n", kind, len(targets))
+			newChan.Reject(ssh.Prohibited, "Forwarding requested by several admins")
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxHeldNotifications is the number of notifications kept for a terminal
+// while a command runs, more are dropped.
+var MaxHeldNotifications = 32
+
+// Notification is a message pushed to the admins, by the brain itself or
+// broadcast by an admin with `wall`.
+type Notification struct {
+	Time time.Time
+	From string // fingerprint of the admin's key, empty for the brain
+	Text string
+}
+
+func (n Notification) String() string {
+	from := "brain"
+	if n.From != "" {
+		from = "admin " + shortIdentity(n.From)
+	}
+	// control characters would mess with the terminals
+	text := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, n.Text)
+	return fmt.Sprintf("[%s] %s: %s", n.Time.UTC().Format("15:04:05"), from, text)
+}
+
+// Notify sends a message to every subscriber, like the brain shell of each
+// admin.
+func (s *SshServer) Notify(from, text string) {
+	n := Notification{Time: time.Now(), From: from, Text: text}
+	log.Printf("Notification %s\n", n)
+
+	var subscribers []func(Notification)
+	s.a.Run(func() {
+		for _, cb := range s.subscribers {
+			subscribers = append(subscribers, cb)
+		}
+	})
+	for _, cb := range subscribers {
+		cb(n)
+	}
+}
+
+// Subscribe calls cb with each notification until the returned function is
+// called. cb must not block.
+func (s *SshServer) Subscribe(cb func(Notification)) (unsubscribe func()) {
+	var id int
+	s.a.Run(func() {
+		s.lastSubscriber++
+		id = s.lastSubscriber
+		s.subscribers[id] = cb
+	})
+	return func() {
+		s.a.Post(func() {
+			delete(s.subscribers, id)
+		})
+	}
+}
+
+// heldNotifications are written to a terminal, unless they are held while a
+// command runs so they don't mix with its output or with a `connect`.
+type heldNotifications struct {
+	m       sync.Mutex
+	held    bool
+	pending []Notification
+}
+
+func (h *heldNotifications) show(w io.Writer, n Notification) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.held {
+		fmt.Fprintf(w, "%s\n", n)
+	} else if len(h.pending) < MaxHeldNotifications {
+		h.pending = append(h.pending, n)
+	}
+}
+
+// hold keeps the notifications until the returned function is called, which
+// writes them.
+func (h *heldNotifications) hold(w io.Writer) (release func()) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.held = true
+	return func() {
+		h.m.Lock()
+		defer h.m.Unlock()
+		h.held = false
+		for _, n := range h.pending {
+			fmt.Fprintf(w, "%s\n", n)
+		}
+		h.pending = nil
+	}
+}
+
+// showNotifications writes the notifications to the terminal until the
+// session ends. The terminal redraws the prompt and the line being edited
+// after them.
+func (t *TerminalSession) showNotifications() (stop func()) {
+	notes := make(chan Notification, 32)
+	done := make(chan struct{})
+	unsubscribe := t.server.Subscribe(func(n Notification) {
+		select {
+		case notes <- n:
+		default:
+			// dropped rather than blocking the others on a slow terminal
+		}
+	})
+	go func() {
+		for {
+			select {
+			case n := <-notes:
+				t.notifications.show(t.term, n)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		close(done)
+	}
+}
+
+func wallCommand(ctx CmdContext, args Arguments) int {
+	if len(args) == 0 {
+		return ctx.Usage("Missing message")
+	}
+	ctx.Server.Notify(ctx.Identity, strings.Join(args, " "))
+	return 0
+}
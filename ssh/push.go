@@ -0,0 +1,282 @@
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/domain"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MaxPushConcurrency is the number of devices a file is pushed to at once.
+var MaxPushConcurrency = 16
+
+type pushFile struct {
+	name string
+	file *os.File
+	size int64
+	hash string
+}
+
+type pushResult struct {
+	id  string
+	err error
+}
+
+// pushCommand sends one file to every matching device and checks its sha256
+// on each of them, e.g. `push /srv/fw.bin /tmp/ --match 'AABB*'`.
+func pushCommand(ctx CmdContext, args Arguments) int {
+	selector := ctx.Flags.Get("--match")
+	if selector == "" {
+		return ctx.Usage("Missing --match")
+	} else if args[0] == "-" && isTerminal(ctx.Channel) {
+		return ctx.Usage("Stdin is a terminal, pipe the file to push -")
+	}
+
+	src, err := openPushFile(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr(), "Error reading %s: %s\n", args[0], err)
+		return 1
+	}
+	defer src.Close()
+
+	nodes := matchNodes(ctx.Server.GetAll(), selector)
+	if len(nodes) == 0 {
+		fmt.Fprintf(ctx.Stderr(), "No device matching %s\n", selector)
+		return 1
+	}
+
+	remotePath := args[1]
+	ctx.Log.Printf("Pushing %s (%d bytes, sha256 %s) to %s on %d devices\n", src.name, src.size, src.hash, remotePath, len(nodes))
+	results := make(chan pushResult, len(nodes))
+	limit := make(chan struct{}, MaxPushConcurrency)
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node domain.Node) {
+			defer wg.Done()
+			select {
+			case limit <- struct{}{}:
+			case <-ctx.Context.Done():
+				results <- pushResult{node.Id(), ctx.Context.Err()}
+				return
+			}
+			defer func() { <-limit }()
+
+			err := src.sendTo(ctx.Context, node, remotePath)
+			if err != nil {
+				ctx.Log.Printf("Error pushing %s to node id %s: %s\n", remotePath, node.Id(), err)
+			}
+			results <- pushResult{node.Id(), err}
+		}(node)
+	}
+	wg.Wait()
+	close(results)
+
+	sorted := make([]pushResult, 0, len(nodes))
+	for res := range results {
+		sorted = append(sorted, res)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].id < sorted[j].id
+	})
+
+	failed := 0
+	for _, res := range sorted {
+		if res.err != nil {
+			failed++
+			fmt.Fprintf(ctx, "%s\tFAILED\t%s\n", res.id, res.err)
+		} else {
+			fmt.Fprintf(ctx, "%s\tOK\n", res.id)
+		}
+	}
+	fmt.Fprintf(ctx, "%d/%d devices updated\n", len(sorted)-failed, len(sorted))
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// matchNodes returns the nodes whose id matches a glob pattern.
+func matchNodes(nodes []domain.Node, selector string) []domain.Node {
+	selector = strings.ToUpper(selector)
+	matching := make([]domain.Node, 0, len(nodes))
+	for _, node := range nodes {
+		if ok, _ := path.Match(selector, strings.ToUpper(node.Id())); ok {
+			matching = append(matching, node)
+		}
+	}
+	return matching
+}
+
+// openPushFile opens a file on the brain or, for `-`, saves stdin to a
+// temporary file so it can be read concurrently for each device.
+func openPushFile(ctx CmdContext, name string) (*pushFile, error) {
+	var file *os.File
+	var err error
+	if strings.HasPrefix(name, "artifact:") {
+		if ctx.Server.artifacts == nil {
+			return nil, fmt.Errorf("Artifact store not configured")
+		}
+		file, a, err := ctx.Server.artifacts.Open(name[len("artifact:"):])
+		if err != nil {
+			return nil, err
+		}
+		return &pushFile{
+			name: a.Name,
+			file: file,
+			size: a.Size,
+			hash: a.Hash,
+		}, nil
+	} else if name == "-" {
+		if file, err = ioutil.TempFile("", "sshbrain-push"); err != nil {
+			return nil, err
+		}
+		os.Remove(file.Name())
+		if _, err = io.Copy(file, ctx); err != nil {
+			file.Close()
+			return nil, err
+		}
+		name = "stdin"
+	} else if file, err = os.Open(name); err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, io.NewSectionReader(file, 0, 1<<62))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &pushFile{
+		name: path.Base(name),
+		file: file,
+		size: size,
+		hash: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+func (f *pushFile) Close() error {
+	return f.file.Close()
+}
+
+// sendTo copies the file to remotePath on the node with the SCP protocol and
+// verifies its sha256 afterward.
+func (f *pushFile) sendTo(ctx context.Context, node domain.Node, remotePath string) error {
+	remotePath, err := f.destination(ctx, node, remotePath)
+	if err != nil {
+		return err
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd, err := startNodeCommand(ctx, node, "scp -t -- "+shellQuote(remotePath), stderr)
+	if err != nil {
+		return err
+	}
+
+	sendErr := f.scpSend(cmd, path.Base(remotePath))
+	status, err := cmd.Wait()
+	if sendErr != nil {
+		return sendErr
+	} else if err != nil {
+		return err
+	} else if status.Code != 0 {
+		return fmt.Errorf("scp exited with status %d: %s", status.Code, strings.TrimSpace(stderr.String()))
+	}
+
+	return f.verify(ctx, node, remotePath)
+}
+
+// destination returns the path of the file on the node, inside remotePath when
+// it's a directory.
+func (f *pushFile) destination(ctx context.Context, node domain.Node, remotePath string) (string, error) {
+	if strings.HasSuffix(remotePath, "/") {
+		return remotePath + f.name, nil
+	}
+
+	cmd, err := startNodeCommand(ctx, node, "test -d "+shellQuote(remotePath), ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin.Close()
+	io.Copy(ioutil.Discard, cmd.Stdout)
+	status, err := cmd.Wait()
+	if err != nil {
+		return "", err
+	} else if status.Code == 0 {
+		return path.Join(remotePath, f.name), nil
+	}
+	return remotePath, nil
+}
+
+func (f *pushFile) scpSend(cmd *nodeCommand, name string) error {
+	acks := bufio.NewReader(cmd.Stdout)
+	if err := readScpAck(acks); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(cmd.Stdin, "C0644 %d %s\n", f.size, name); err != nil {
+		return err
+	}
+	if err := readScpAck(acks); err != nil {
+		return err
+	}
+	if _, err := io.Copy(cmd.Stdin, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+		return err
+	}
+	if _, err := cmd.Stdin.Write([]byte{0}); err != nil {
+		return err
+	}
+	return readScpAck(acks)
+}
+
+func (f *pushFile) verify(ctx context.Context, node domain.Node, remotePath string) error {
+	stderr := &bytes.Buffer{}
+	cmd, err := startNodeCommand(ctx, node, "sha256sum -- "+shellQuote(remotePath), stderr)
+	if err != nil {
+		return err
+	}
+
+	cmd.Stdin.Close()
+	out, readErr := ioutil.ReadAll(cmd.Stdout)
+	status, err := cmd.Wait()
+	if readErr != nil {
+		return readErr
+	} else if err != nil {
+		return err
+	} else if status.Code != 0 {
+		return fmt.Errorf("sha256sum exited with status %d: %s", status.Code, strings.TrimSpace(stderr.String()))
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || fields[0] != f.hash {
+		return fmt.Errorf("Checksum mismatch: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readScpAck reads the acknowledgement of a message sent to an scp sink.
+func readScpAck(r *bufio.Reader) error {
+	status, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == 0 {
+		return nil
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("scp: %s", strings.TrimSpace(line))
+}
@@ -0,0 +1,228 @@
+package ssh
+
+import (
+	"github.com/JeanSebTr/SshBrain/domain"
+	"golang.org/x/crypto/ssh"
+	"sync"
+)
+
+// forwardedChannelTypes maps session requests asking a node to forward
+// something back to the admin to the type of the channels it will open.
+var forwardedChannelTypes = map[string]string{
+	"auth-agent-req@openssh.com": "auth-agent@openssh.com",
+	"x11-req":                    "x11",
+}
+
+// channelForwarder is implemented by sessions able to route channels opened
+// back by the node, for agent or X11 forwarding, to an admin connection until
+// release is called.
+type channelForwarder interface {
+	forwardChannels(kind string, c *SshConnection) (release func())
+}
+
+// sessionRequests handles the requests of an admin session on the brain. The
+// terminal settings and environment are kept for the brain shell and replayed
+// on device sessions attached by commands like `connect`, to which every
+// later request is forwarded. Requests are forwarded without holding the
+// lock, as they may wait for the reply of the device.
+type sessionRequests struct {
+	m        sync.Mutex
+	conn     *SshConnection
+	pty      *domain.PtyRequest
+	env      []EnvRequest
+	forwards []*ssh.Request
+	target   domain.Session
+	releases []func()
+	onResize func(width, height int)
+	onSignal func()
+	done     chan struct{}
+}
+
+func newSessionRequests(conn *SshConnection) *sessionRequests {
+	return &sessionRequests{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+// Pty returns a copy of the current terminal settings, nil without a pty.
+func (r *sessionRequests) Pty() *domain.PtyRequest {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.pty == nil {
+		return nil
+	}
+	pty := *r.pty
+	return &pty
+}
+
+// OnResize registers the callback called when the terminal size changes.
+func (r *sessionRequests) OnResize(cb func(width, height int)) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.onResize = cb
+	if r.pty != nil {
+		cb(int(r.pty.CharWidth), int(r.pty.CharHeight))
+	}
+}
+
+// Attach forwards the session environment and all later requests to a device
+// session until the returned function is called.
+func (r *sessionRequests) Attach(session domain.Session) (detach func()) {
+	r.m.Lock()
+	env := append([]EnvRequest(nil), r.env...)
+	forwards := append([]*ssh.Request(nil), r.forwards...)
+	r.target = session
+	r.m.Unlock()
+
+	for _, env := range env {
+		r.forward(session, "env", false, ssh.Marshal(env))
+	}
+	for _, req := range forwards {
+		r.forward(session, req.Type, false, req.Payload)
+	}
+
+	return func() {
+		r.m.Lock()
+		var releases []func()
+		if r.target == session {
+			r.target = nil
+			releases, r.releases = r.releases, nil
+		}
+		r.m.Unlock()
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// OnSignal registers the callback called for signal requests while no device
+// session is attached, until the returned function is called.
+func (r *sessionRequests) OnSignal(cb func()) (restore func()) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	previous := r.onSignal
+	r.onSignal = cb
+	return func() {
+		r.m.Lock()
+		defer r.m.Unlock()
+		r.onSignal = previous
+	}
+}
+
+// Done is closed once the session channel is closed.
+func (r *sessionRequests) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *sessionRequests) serve(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		r.handle(req)
+	}
+	close(r.done)
+}
+
+func (r *sessionRequests) handle(req *ssh.Request) {
+	var err error
+	ok, forward := false, false
+
+	r.m.Lock()
+	target := r.target
+	switch req.Type {
+	case "pty-req":
+		pty := &domain.PtyRequest{}
+		if err = ssh.Unmarshal(req.Payload, pty); err == nil {
+			r.pty = pty
+			r.resize()
+			ok = true
+		}
+	case "window-change":
+		data := WindowChangeRequest{}
+		if err = ssh.Unmarshal(req.Payload, &data); err == nil {
+			if r.pty != nil {
+				r.pty.CharWidth = data.Columns
+				r.pty.CharHeight = data.Rows
+				r.pty.PxWidth = data.Width
+				r.pty.PxHeight = data.Height
+				r.resize()
+			}
+			ok, forward = target == nil, true
+		}
+	case "env":
+		data := EnvRequest{}
+		if err = ssh.Unmarshal(req.Payload, &data); err == nil {
+			r.env = append(r.env, data)
+			ok, forward = target == nil, true
+		}
+	case "signal":
+		data := SignalRequest{}
+		if err = ssh.Unmarshal(req.Payload, &data); err == nil {
+			if target == nil && r.onSignal != nil {
+				r.onSignal()
+				ok = true
+			} else {
+				forward = true
+			}
+		}
+	case "break":
+		data := BreakRequest{}
+		if err = ssh.Unmarshal(req.Payload, &data); err == nil {
+			forward = true
+		}
+	case "x11-req":
+		data := X11Request{}
+		if err = ssh.Unmarshal(req.Payload, &data); err == nil {
+			r.forwards = append(r.forwards, req)
+			ok, forward = target == nil, true
+		}
+	case "auth-agent-req@openssh.com":
+		r.forwards = append(r.forwards, req)
+		ok, forward = target == nil, true
+	default:
+		r.conn.log.Printf("Unknown req %s(%v) %v\n", req.Type, req.Payload, req.WantReply)
+	}
+	r.m.Unlock()
+
+	if forward && target != nil {
+		ok = r.forward(target, req.Type, req.WantReply, req.Payload)
+	}
+	if err != nil {
+		r.conn.log.Printf("Error parsing %s request: %s\n", req.Type, err)
+	}
+	if req.WantReply {
+		req.Reply(ok, nil)
+	}
+}
+
+func (r *sessionRequests) resize() {
+	if r.onResize != nil {
+		r.onResize(int(r.pty.CharWidth), int(r.pty.CharHeight))
+	}
+}
+
+// forward sends a request to the attached device session, asking the node to
+// route channels opened back for agent or X11 forwarding to this admin.
+func (r *sessionRequests) forward(session domain.Session, name string, wantReply bool, payload []byte) bool {
+	if session == nil {
+		return false
+	}
+	if kind, ok := forwardedChannelTypes[name]; ok {
+		if f, ok := session.(channelForwarder); ok {
+			release := f.forwardChannels(kind, r.conn)
+			r.m.Lock()
+			if r.target == session {
+				r.releases = append(r.releases, release)
+			} else {
+				release()
+			}
+			r.m.Unlock()
+		}
+	}
+
+	ok, err := session.SendRequest(name, wantReply, payload)
+	if err != nil {
+		r.conn.log.Printf("Error forwarding %s request: %s\n", name, err)
+		return false
+	}
+	return ok || !wantReply
+}
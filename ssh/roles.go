@@ -0,0 +1,83 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"strings"
+)
+
+// GrantRole gives a role to admin keys, in authorized_keys format. Commands
+// registered with a Role can only be run with the keys having it.
+func (s *SshServer) GrantRole(role string, keys ...string) error {
+	if role == "" {
+		return fmt.Errorf("Role needs a name")
+	}
+	fingerprints := make([]string, len(keys))
+	for i, key := range keys {
+		pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return fmt.Errorf("Invalid key for role %s: %s", role, err)
+		}
+		fingerprints[i] = ssh.FingerprintSHA256(pubkey)
+	}
+
+	s.a.Run(func() {
+		for _, fp := range fingerprints {
+			if !hasRole(s.roles[fp], role) {
+				s.roles[fp] = append(s.roles[fp], role)
+			}
+		}
+	})
+	return nil
+}
+
+// LoadRoles grants the roles listed in the file at path, one per line as the
+// role followed by an admin key in authorized_keys format, e.g.
+// `jobs ssh-ed25519 AAAA... alice`. Empty lines and lines starting with # are
+// ignored.
+func (s *SshServer) LoadRoles(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: Expected a role and a key", path, n)
+		}
+		if err := s.GrantRole(fields[0], strings.TrimSpace(fields[1])); err != nil {
+			return fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// HasRole tells if the admin key with the given fingerprint has a role. Every
+// admin has the empty role.
+func (s *SshServer) HasRole(identity, role string) (has bool) {
+	if role == "" {
+		return true
+	}
+	s.a.Run(func() {
+		has = hasRole(s.roles[identity], role)
+	})
+	return
+}
+
+func hasRole(roles []string, role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
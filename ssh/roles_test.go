@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLoadRoles(t *testing.T) {
+	var keys []string
+	var identities []string
+	for i := 0; i < 2; i++ {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubkey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))))
+		identities = append(identities, ssh.FingerprintSHA256(pubkey))
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "roles")
+	roles := "# admins allowed to cancel every job\n\njobs " + keys[0] + " alice\n  services   " + keys[1] + "\njobs " + keys[1] + "\n"
+	if err := ioutil.WriteFile(path, []byte(roles), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server, _ := newTestServer(t)
+	if err := server.LoadRoles(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		identity, role string
+		has            bool
+	}{
+		{identities[0], JobsRole, true},
+		{identities[0], ServicesRole, false},
+		{identities[1], JobsRole, true},
+		{identities[1], ServicesRole, true},
+		{"SHA256:other", JobsRole, false},
+	} {
+		if has := server.HasRole(test.identity, test.role); has != test.has {
+			t.Errorf("HasRole(%s, %s) = %t, want %t", test.identity, test.role, has, test.has)
+		}
+	}
+
+	for _, invalid := range []string{"jobs\n", "jobs ssh-ed25519 invalid\n"} {
+		if err := ioutil.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := server.LoadRoles(path); err == nil || !strings.Contains(err.Error(), path+":1:") {
+			t.Errorf("LoadRoles of %q = %v, want an error on line 1", invalid, err)
+		}
+	}
+	if err := server.LoadRoles(filepath.Join(dir, "missing")); err == nil {
+		t.Error("LoadRoles of a missing file should fail")
+	}
+}
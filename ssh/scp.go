@@ -1 +1,429 @@
 package ssh
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/domain"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxScpFileSize is the largest file relayed by the scp command, in bytes.
+var MaxScpFileSize int64 = 256 << 20
+
+// ScpProgressInterval is how often the progress of a file relayed by the scp
+// command is logged.
+var ScpProgressInterval = 10 * time.Second
+
+type scpOptions struct {
+	sink      bool // -t, files are sent to the device
+	source    bool // -f, files are read from the device
+	recursive bool // -r
+	preserve  bool // -p
+	targetDir bool // -d
+	path      string
+}
+
+// parseScpArgs parses the arguments given by an scp client to the remote scp.
+// Everything after the flags is the path, which may contain spaces.
+func parseScpArgs(args Arguments) (scpOptions, error) {
+	opts := scpOptions{}
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				opts.sink = true
+			case 'f':
+				opts.source = true
+			case 'r':
+				opts.recursive = true
+			case 'p':
+				opts.preserve = true
+			case 'd':
+				opts.targetDir = true
+			case 'v':
+			default:
+				return opts, fmt.Errorf("Unknown flag -%c", flag)
+			}
+		}
+	}
+
+	opts.path = args[i:].String()
+	if opts.sink == opts.source {
+		return opts, fmt.Errorf("Expected one of -t or -f")
+	}
+	if opts.path == "" {
+		return opts, fmt.Errorf("Missing path")
+	}
+	return opts, nil
+}
+
+// command returns the scp command line to run on the device for nodePath.
+func (opts scpOptions) command(nodePath string) string {
+	cmd := "scp"
+	if opts.recursive {
+		cmd += " -r"
+	}
+	if opts.preserve {
+		cmd += " -p"
+	}
+	if opts.targetDir {
+		cmd += " -d"
+	}
+	if opts.sink {
+		cmd += " -t"
+	} else {
+		cmd += " -f"
+	}
+	return cmd + " -- " + shellQuote(nodePath)
+}
+
+// shellQuote quotes str as a single argument for a POSIX shell.
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'\''`, -1) + "'"
+}
+
+// scpCommand relays an scp transfer between the admin and the device named by
+// the first component of the path, e.g. `scp -O fw.bin root@brain:/AABBCCDDEEFF/tmp`.
+func scpCommand(ctx CmdContext, args Arguments) int {
+	var restore func()
+	ctx.Channel, restore = ctx.Raw()
+	defer restore()
+	opts, err := parseScpArgs(args)
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr(), "scp: %s\n", err)
+		return 1
+	}
+
+	target, nodePath := splitDevicePath(opts.path)
+	if target == "" {
+		fmt.Fprintf(ctx.Stderr(), "scp: Missing device id in path %s\n", opts.path)
+		return 1
+	} else if target == ArtifactsDir {
+		return scpArtifacts(ctx, opts, nodePath)
+	}
+
+	node, err := ctx.Server.GetById(target)
+	if err != nil || node == nil {
+		if err != nil {
+			ctx.Log.Printf("Error finding node id %s: %s\n", target, err)
+		}
+		fmt.Fprintf(ctx.Stderr(), "scp: Node id %s not found\n", target)
+		return 1
+	}
+
+	cmd, err := startNodeCommand(ctx.Context, node, opts.command(nodePath), ctx.Stderr())
+	if err != nil {
+		ctx.Log.Printf("Error creating session on node id %s: %s\n", target, err)
+		fmt.Fprintf(ctx.Stderr(), "scp: Error connecting to %s\n", target)
+		return 1
+	}
+
+	relay := &scpRelay{
+		log:    ctx.Log,
+		prefix: target + ":",
+	}
+	if opts.sink {
+		relay.src, relay.srcAck = bufio.NewReader(ctx), ctx
+		relay.dst, relay.dstAck = cmd.Stdin, bufio.NewReader(cmd.Stdout)
+	} else {
+		relay.src, relay.srcAck = bufio.NewReader(cmd.Stdout), cmd.Stdin
+		relay.dst, relay.dstAck = ctx, bufio.NewReader(ctx)
+	}
+
+	relayErr := relay.Run()
+	status, err := cmd.Wait()
+	if relayErr != nil {
+		ctx.Log.Printf("Error relaying scp to node id %s: %s\n", target, relayErr)
+		return 1
+	}
+	if err != nil {
+		ctx.Log.Printf("Error running scp on node id %s: %s\n", target, err)
+		return 1
+	}
+	return ctx.Exit(status)
+}
+
+// scpRelay relays the SCP protocol from a source to a sink. Each message is
+// validated, transferred files are logged and MaxScpFileSize is enforced.
+type scpRelay struct {
+	src    *bufio.Reader // messages and file data from the source
+	srcAck io.Writer     // acknowledgements to the source
+	dst    io.Writer     // messages and file data to the sink
+	dstAck *bufio.Reader // acknowledgements from the sink
+	log    *log.Logger
+	prefix string
+	dir    string
+}
+
+func (r *scpRelay) Run() error {
+	// the sink starts by telling it's ready
+	if err := r.relayAck(); err != nil {
+		return err
+	}
+
+	for {
+		kind, err := r.src.ReadByte()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line, err := r.src.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		msg := string(kind) + line
+
+		switch kind {
+		case 'C':
+			err = r.relayFile(msg)
+		case 'D':
+			var name string
+			if _, name, err = parseScpEntry(msg); err == nil {
+				r.dir += name + "/"
+				err = r.relayMessage(msg)
+			}
+		case 'E':
+			if i := strings.LastIndex(strings.TrimSuffix(r.dir, "/"), "/"); i != -1 {
+				r.dir = r.dir[:i+1]
+			} else {
+				r.dir = ""
+			}
+			err = r.relayMessage(msg)
+		case 'T':
+			err = r.relayMessage(msg)
+		case 1, 2:
+			// errors from the source are not acknowledged by the sink
+			r.log.Printf("scp %s%s error: %s", r.prefix, r.dir, line)
+			if _, err = io.WriteString(r.dst, msg); err == nil && kind == 2 {
+				return fmt.Errorf("Source failed: %s", strings.TrimSpace(line))
+			}
+		default:
+			r.abort("scp: protocol error")
+			return fmt.Errorf("Unexpected scp message %q", msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *scpRelay) relayFile(msg string) error {
+	size, name, err := parseScpEntry(msg)
+	if err != nil {
+		r.abort("scp: protocol error")
+		return err
+	}
+	if size > MaxScpFileSize {
+		r.abort(fmt.Sprintf("scp: %s: file too large (%d > %d bytes)", name, size, MaxScpFileSize))
+		return fmt.Errorf("File %s%s too large (%d bytes)", r.dir, name, size)
+	}
+
+	if err := r.relayMessage(msg); err != nil {
+		return err
+	}
+
+	r.log.Printf("scp %s%s%s: transferring %d bytes\n", r.prefix, r.dir, name, size)
+	progress := &progressWriter{
+		Writer: r.dst,
+		log:    r.log,
+		name:   r.prefix + r.dir + name,
+		size:   size,
+		last:   time.Now(),
+	}
+	if _, err := io.CopyN(progress, r.src, size); err != nil {
+		return err
+	}
+
+	// the source ends the file data with its own status
+	status, err := r.src.ReadByte()
+	if err != nil {
+		return err
+	}
+	trailer := []byte{status}
+	if status != 0 {
+		line, err := r.src.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		trailer = append(trailer, line...)
+	}
+	if _, err := r.dst.Write(trailer); err != nil {
+		return err
+	}
+
+	if err := r.relayAck(); err != nil {
+		return err
+	}
+	r.log.Printf("scp %s%s%s: done\n", r.prefix, r.dir, name)
+	return nil
+}
+
+// progressWriter logs how much of a file was written every
+// ScpProgressInterval.
+type progressWriter struct {
+	io.Writer
+	log     *log.Logger
+	name    string
+	size    int64
+	written int64
+	last    time.Time
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	if now := time.Now(); now.Sub(w.last) >= ScpProgressInterval {
+		w.last = now
+		w.log.Printf("scp %s: %d/%d bytes (%d%%)\n", w.name, w.written, w.size, w.written*100/w.size)
+	}
+	return n, err
+}
+
+func (r *scpRelay) relayMessage(msg string) error {
+	if _, err := io.WriteString(r.dst, msg); err != nil {
+		return err
+	}
+	return r.relayAck()
+}
+
+// relayAck forwards one acknowledgement from the sink to the source.
+func (r *scpRelay) relayAck() error {
+	status, err := r.dstAck.ReadByte()
+	if err != nil {
+		return err
+	}
+	ack := []byte{status}
+	var line string
+	if status != 0 {
+		if line, err = r.dstAck.ReadString('\n'); err != nil {
+			return err
+		}
+		ack = append(ack, line...)
+	}
+	if _, err := r.srcAck.Write(ack); err != nil {
+		return err
+	}
+
+	switch status {
+	case 0:
+		return nil
+	case 1:
+		r.log.Printf("scp %s%s warning: %s", r.prefix, r.dir, line)
+		return nil
+	default:
+		return fmt.Errorf("Sink failed: %s", strings.TrimSpace(line))
+	}
+}
+
+// abort tells both sides the transfer failed.
+func (r *scpRelay) abort(msg string) {
+	fmt.Fprintf(r.srcAck, "\x02%s\n", msg)
+	fmt.Fprintf(r.dst, "\x02%s\n", msg)
+}
+
+// parseScpEntry parses a `C0644 <size> <name>` or `D0755 0 <name>` message.
+func parseScpEntry(msg string) (size int64, name string, err error) {
+	parts := strings.SplitN(strings.TrimSuffix(msg, "\n"), " ", 3)
+	if len(parts) != 3 || len(parts[0]) != 5 {
+		return 0, "", fmt.Errorf("Invalid scp message %q", msg)
+	}
+	if _, err := strconv.ParseUint(parts[0][1:], 8, 32); err != nil {
+		return 0, "", fmt.Errorf("Invalid mode in scp message %q", msg)
+	}
+	if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil || size < 0 {
+		return 0, "", fmt.Errorf("Invalid size in scp message %q", msg)
+	}
+	name = parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return 0, "", fmt.Errorf("Invalid file name in scp message %q", msg)
+	}
+	return size, name, nil
+}
+
+// nodeCommand is a command running on a node with pipes for stdin and stdout.
+type nodeCommand struct {
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	done   chan nodeCommandResult
+}
+
+type nodeCommandResult struct {
+	status domain.ExitStatus
+	err    error
+}
+
+// startNodeCommand runs cmd on a node, writing its stderr to stderr. The
+// session is closed if ctx is done first.
+func startNodeCommand(ctx context.Context, node domain.Node, cmd string, stderr io.Writer) (*nodeCommand, error) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	session, err := node.NewSession(pipeChannel{stdinReader, stdoutWriter, stderrChannel{stderr}}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &nodeCommand{
+		Stdin:  stdinWriter,
+		Stdout: stdoutReader,
+		done:   make(chan nodeCommandResult, 1),
+	}
+	go func() {
+		stop := closeOnDone(ctx, session)
+		status, err := session.Exec(cmd)
+		stop()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		stdoutWriter.Close()
+		stdinReader.Close()
+		c.done <- nodeCommandResult{status, err}
+	}()
+	return c, nil
+}
+
+// Wait closes stdin, discards the remaining output and waits for the command
+// to exit.
+func (c *nodeCommand) Wait() (domain.ExitStatus, error) {
+	c.Stdin.Close()
+	go io.Copy(ioutil.Discard, c.Stdout)
+	res := <-c.done
+	return res.status, res.err
+}
+
+// pipeChannel is a domain.Channel made of separate streams.
+type pipeChannel struct {
+	io.Reader
+	io.Writer
+	stderr io.ReadWriter
+}
+
+func (c pipeChannel) Stderr() io.ReadWriter {
+	return c.stderr
+}
+
+// stderrChannel is a write only stderr stream.
+type stderrChannel struct {
+	io.Writer
+}
+
+func (c stderrChannel) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
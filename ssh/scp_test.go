@@ -0,0 +1,69 @@
+package ssh
+
+import "testing"
+
+func TestParseScpArgs(t *testing.T) {
+	tests := []struct {
+		args Arguments
+		opts scpOptions
+		err  bool
+	}{
+		{Arguments{"-t", "/tmp"}, scpOptions{sink: true, path: "/tmp"}, false},
+		{Arguments{"-v", "-rpf", "--", "-a file"}, scpOptions{source: true, recursive: true, preserve: true, path: "-a file"}, false},
+		{Arguments{"-d", "-t", "a", "b"}, scpOptions{sink: true, targetDir: true, path: "a b"}, false},
+		{Arguments{"-t", "-"}, scpOptions{sink: true, path: "-"}, false},
+		{Arguments{"-tx", "/tmp"}, scpOptions{}, true},
+		{Arguments{"-t", "-f", "/tmp"}, scpOptions{}, true},
+		{Arguments{"/tmp"}, scpOptions{}, true},
+		{Arguments{"-t"}, scpOptions{}, true},
+	}
+	for _, test := range tests {
+		opts, err := parseScpArgs(test.args)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseScpArgs(%q) = %+v, want an error", test.args, opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScpArgs(%q) error: %s", test.args, err)
+		} else if opts != test.opts {
+			t.Errorf("parseScpArgs(%q) = %+v, want %+v", test.args, opts, test.opts)
+		}
+	}
+}
+
+func TestParseScpEntry(t *testing.T) {
+	tests := []struct {
+		msg  string
+		size int64
+		name string
+		err  bool
+	}{
+		{"C0644 12 file.txt\n", 12, "file.txt", false},
+		{"C0600 0 with spaces \n", 0, "with spaces ", false},
+		{"D0755 0 dir", 0, "dir", false},
+		{"C0644 12\n", 0, "", true},
+		{"C644 12 file\n", 0, "", true},
+		{"C0984 12 file\n", 0, "", true},
+		{"C0644 -1 file\n", 0, "", true},
+		{"C0644 x file\n", 0, "", true},
+		{"C0644 12 \n", 0, "", true},
+		{"D0755 0 ..\n", 0, "", true},
+		{"C0644 12 ../file\n", 0, "", true},
+	}
+	for _, test := range tests {
+		size, name, err := parseScpEntry(test.msg)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseScpEntry(%q) = %d, %q, want an error", test.msg, size, name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseScpEntry(%q) error: %s", test.msg, err)
+		} else if size != test.size || name != test.name {
+			t.Errorf("parseScpEntry(%q) = %d, %q, want %d, %q", test.msg, size, name, test.size, test.name)
+		}
+	}
+}
@@ -3,7 +3,10 @@ package ssh
 import (
 	"fmt"
 	"github.com/JeanSebTr/SshBrain/actor"
+	"github.com/JeanSebTr/SshBrain/artifact"
 	"github.com/JeanSebTr/SshBrain/domain"
+	"github.com/JeanSebTr/SshBrain/inventory"
+	"github.com/JeanSebTr/SshBrain/logstore"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"log"
@@ -12,12 +15,36 @@ import (
 )
 
 type SshServer struct {
-	a        *actor.Actor
-	config   *ssh.ServerConfig
-	clients  map[string]*Node
-	services map[uint32]func(*SshConnection, net.Conn)
+	a         *actor.Actor
+	config    *ssh.ServerConfig
+	clients   map[string]*Node
+	services  map[string]*Service
+	artifacts *artifact.Store
+	logs      *logstore.Store
+	inventory *inventory.Store
+	history   *historyStore
+	cmds      Cmds
+	// roles of the admin keys, by fingerprint
+	roles map[string][]string
+
+	jobs      map[int]*job
+	lastJobId int
+
+	subscribers    map[int]func(Notification)
+	lastSubscriber int
+
+	exposures     map[string]*exposure
+	exposuresPath string
+
+	// services added with AddService, by name
+	serviceSpecs map[string]ServiceSpec
+	servicesPath string
 }
 
+// DeviceUserPrefix is prepended to a device id to log in as an admin directly
+// on that device, e.g. `ssh admin+AABBCCDDEEFF@brain uptime`.
+const DeviceUserPrefix = "admin+"
+
 type ConnectionFactory func() (net.Conn, error)
 type ServiceCallback func(*SshConnection, net.Conn)
 
@@ -29,12 +56,13 @@ func NewServer(keyPath string, adminKeys []string) *SshServer {
 			pubkey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
 			log.Printf("PubKey: %s\n", pubkey)
 
-			if conn.User() == "root" && !isAdminKey(pubkey, adminKeys) {
+			if isAdminUser(conn.User()) && !isAdminKey(pubkey, adminKeys) {
 				return nil, fmt.Errorf("Not authorized")
 			}
 
 			return &ssh.Permissions{Extensions: map[string]string{
 				"key-id": pubkey,
+				"key-fp": ssh.FingerprintSHA256(key),
 			}}, nil
 		},
 	}
@@ -50,15 +78,41 @@ func NewServer(keyPath string, adminKeys []string) *SshServer {
 	config.AddHostKey(private)
 
 	server := &SshServer{
-		a:        actor.NewActor(),
-		config:   config,
-		clients:  make(map[string]*Node),
-		services: make(map[uint32]func(*SshConnection, net.Conn)),
+		a:         actor.NewActor(),
+		config:    config,
+		clients:   make(map[string]*Node),
+		services:  make(map[string]*Service),
+		exposures: make(map[string]*exposure),
+		cmds:      make(Cmds),
+		roles:     make(map[string][]string),
+		jobs:      make(map[int]*job),
+
+		subscribers: make(map[int]func(Notification)),
+
+		serviceSpecs: make(map[string]ServiceSpec),
+	}
+
+	server.RegisterService(Service{
+		Name:        "services",
+		Description: "List the services offered by the brain",
+		Port:        1,
+		Handler:     server.discoveryService,
+	})
+	for name, cmd := range builtinCommands {
+		if err := server.RegisterCommand(name, cmd); err != nil {
+			panic(err)
+		}
 	}
 
 	return server
 }
 
+// isAdminUser tells if user designates an admin, either on the brain itself
+// (`root`) or routed directly to a node (`admin+<device-id>`).
+func isAdminUser(user string) bool {
+	return user == "root" || strings.HasPrefix(user, DeviceUserPrefix)
+}
+
 func isAdminKey(key string, adminKeys []string) bool {
 	for _, adminKey := range adminKeys {
 		if adminKey == key {
@@ -88,11 +142,10 @@ func (s *SshServer) Listen(address string) {
 	}
 }
 
-func (s *SshServer) ExposeService(port uint32, handler func(*SshConnection, net.Conn)) {
-	if _, exists := s.services[port]; exists {
-		panic(fmt.Errorf("Port %d is already exposed", port))
-	}
-	s.services[port] = handler
+// SetArtifactStore enables uploading files to the brain, at `/artifacts` with
+// scp or sftp, to push them to devices later.
+func (s *SshServer) SetArtifactStore(store *artifact.Store) {
+	s.artifacts = store
 }
 
 func (s *SshServer) handleClient(conn net.Conn) {
@@ -105,52 +158,62 @@ func (s *SshServer) handleClient(conn net.Conn) {
 
 	client := NewConnection(s, sConn, chans, reqs)
 
-	if client.User() != "root" {
+	if !client.isAdmin() {
+		mac := strings.ToUpper(client.User())
+		node := NewNode(client)
 		s.a.Post(func() {
-			mac := strings.ToUpper(client.User())
-			s.clients[mac] = NewNode(client)
+			s.clients[mac] = node
 		})
+		s.Notify("", fmt.Sprintf("Device %s connected from %s", mac, client.RemoteAddr()))
+
+		go func() {
+			sConn.Wait()
+			s.a.Post(func() {
+				// unless it already reconnected
+				if s.clients[mac] == node {
+					delete(s.clients, mac)
+				}
+			})
+			s.Notify("", fmt.Sprintf("Device %s disconnected", mac))
+		}()
 	}
 
 	go client.handleConnection()
 }
 
-func (s *SshServer) handleServiceRequest(port uint32, client *SshConnection, builder ConnectionFactory) error {
-	var (
-		handler ServiceCallback
-		exists  bool
-	)
-	if handler, exists = s.services[port]; !exists {
-		return fmt.Errorf("No service on port %d", port)
-	}
-
-	conn, err := builder()
-	if err != nil {
-		return err
-	}
-	go handler(client, conn)
-	return nil
+func (s *SshServer) Count() (count int) {
+	s.a.Run(func() {
+		count = len(s.clients)
+	})
+	return
 }
 
-func (s *SshServer) Count() int {
-	return len(s.clients)
-}
-
-func (s *SshServer) GetAll() []domain.Node {
-	nodes := make([]domain.Node, 0, len(s.clients))
-
-	for _, node := range s.clients {
-		nodes = append(nodes, node)
-	}
-
-	return nodes
+func (s *SshServer) GetAll() (nodes []domain.Node) {
+	s.a.Run(func() {
+		nodes = make([]domain.Node, 0, len(s.clients))
+		for _, node := range s.clients {
+			nodes = append(nodes, node)
+		}
+	})
+	return
 }
 
 func (s *SshServer) GetById(id string) (domain.Node, error) {
-	mac := strings.ToUpper(id)
-	if node, ok := s.clients[mac]; ok {
+	if node := s.getNode(id); node != nil {
 		return node, nil
 	} else {
 		return nil, nil
 	}
 }
+
+func (s *SshServer) getNode(id string) (node *Node) {
+	s.a.Run(func() {
+		node = s.lookupNode(id)
+	})
+	return
+}
+
+// lookupNode must be called from the server actor.
+func (s *SshServer) lookupNode(id string) *Node {
+	return s.clients[strings.ToUpper(id)]
+}
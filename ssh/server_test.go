@@ -0,0 +1,114 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/nettest"
+)
+
+// newTestServer starts a server with a new host key on a local listener.
+func newTestServer(t *testing.T) (*SshServer, string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "host_key")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(keyPath, nil)
+
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleClient(conn)
+		}
+	}()
+	return server, l.Addr().String()
+}
+
+// dialDevice connects to addr as the device id.
+func dialDevice(t *testing.T, addr, id string) *ssh.Client {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            id,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNodesConnectingWhileListed(t *testing.T) {
+	server, addr := newTestServer(t)
+
+	done := make(chan struct{})
+	listed := make(chan struct{})
+	go func() {
+		defer close(listed)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, node := range server.GetAll() {
+				node.Id()
+			}
+			server.Count()
+			server.GetById("aabbccddeeff")
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		client := dialDevice(t, addr, "aabbccddeeff")
+		waitFor(t, "the device to connect", func() bool {
+			node, _ := server.GetById("AABBCCDDEEFF")
+			return node != nil
+		})
+		client.Close()
+		waitFor(t, "the device to disconnect", func() bool {
+			return server.Count() == 0
+		})
+	}
+	close(done)
+	<-listed
+}
@@ -0,0 +1,308 @@
+package ssh
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServicesRole lets an admin add and remove services with `services`, which
+// everyone can list.
+const ServicesRole = "services"
+
+// Service is offered by the brain to devices through direct-tcpip channels,
+// or UdpChannelType channels for UDP services. Devices reach it by port or by
+// name, e.g. `ssh -L 1313:daytime:0 brain`.
+type Service struct {
+	Name        string
+	Description string
+	Port        uint32 // 0 for a service only reachable by name
+	// Udp services get a conn where each Read and Write is a datagram.
+	Udp     bool
+	Handler ServiceCallback
+	// Devices restricts the service to the device ids matching one of these
+	// glob patterns, all devices are allowed when empty.
+	Devices []string
+
+	stats *serviceCounters
+}
+
+// serviceCounters are updated while the service is used.
+type serviceCounters struct {
+	connections atomic.Uint64
+	rejected    atomic.Uint64
+	active      atomic.Int64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+}
+
+// ServiceStats counts the connections to a service.
+type ServiceStats struct {
+	Connections uint64 // accepted connections
+	Rejected    uint64 // connections refused by the device ACL
+	Active      int64
+	BytesIn     uint64 // bytes received from devices
+	BytesOut    uint64 // bytes sent to devices
+}
+
+// ServiceInfo is a snapshot of a registered service.
+type ServiceInfo struct {
+	Name        string
+	Description string
+	Port        uint32
+	Udp         bool
+	Devices     []string
+	Stats       ServiceStats
+}
+
+// Allows tells if a device is allowed to use the service.
+func (svc *Service) Allows(id string) bool {
+	return allowsDevice(svc.Devices, id)
+}
+
+func allowsDevice(patterns []string, id string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	id = strings.ToUpper(id)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToUpper(pattern), id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (svc *Service) info() ServiceInfo {
+	return ServiceInfo{
+		Name:        svc.Name,
+		Description: svc.Description,
+		Port:        svc.Port,
+		Udp:         svc.Udp,
+		Devices:     svc.Devices,
+		Stats: ServiceStats{
+			Connections: svc.stats.connections.Load(),
+			Rejected:    svc.stats.rejected.Load(),
+			Active:      svc.stats.active.Load(),
+			BytesIn:     svc.stats.bytesIn.Load(),
+			BytesOut:    svc.stats.bytesOut.Load(),
+		},
+	}
+}
+
+// RegisterService makes a service available to devices. Names and ports must
+// be unique.
+func (s *SshServer) RegisterService(svc Service) (err error) {
+	if svc.Name == "" || svc.Handler == nil {
+		return fmt.Errorf("Service needs a name and a handler")
+	}
+
+	s.a.Run(func() {
+		err = s.registerService(svc)
+	})
+	return
+}
+
+// registerService must be called from the server actor.
+func (s *SshServer) registerService(svc Service) error {
+	for _, other := range s.services {
+		if other.Name == svc.Name {
+			return fmt.Errorf("Service %s is already registered", svc.Name)
+		} else if svc.Port != 0 && other.Port == svc.Port && other.Udp == svc.Udp {
+			return fmt.Errorf("Port %s is already used by service %s", portString(svc.Port, svc.Udp), other.Name)
+		}
+	}
+	svc.stats = &serviceCounters{}
+	s.services[svc.Name] = &svc
+	return nil
+}
+
+// UnregisterService removes a service, it isn't restored anymore if it was
+// added with AddService.
+func (s *SshServer) UnregisterService(name string) (err error) {
+	s.a.Run(func() {
+		if _, exists := s.services[name]; !exists {
+			err = fmt.Errorf("No service named %s", name)
+			return
+		}
+		delete(s.services, name)
+		if _, added := s.serviceSpecs[name]; added {
+			delete(s.serviceSpecs, name)
+			err = s.saveServices()
+		}
+	})
+	return
+}
+
+// Services returns the registered services sorted by port.
+func (s *SshServer) Services() []ServiceInfo {
+	var infos []ServiceInfo
+	s.a.Run(func() {
+		infos = make([]ServiceInfo, 0, len(s.services))
+		for _, svc := range s.services {
+			infos = append(infos, svc.info())
+		}
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Port < infos[j].Port
+	})
+	return infos
+}
+
+// findService returns the service named host or, when host isn't a service
+// name, the one listening on port with the same protocol.
+func (s *SshServer) findService(host string, port uint32, udp bool) (svc *Service) {
+	s.a.Run(func() {
+		if svc = s.services[host]; svc != nil {
+			if svc.Udp != udp {
+				svc = nil
+			}
+			return
+		}
+		for _, other := range s.services {
+			if port != 0 && other.Port == port && other.Udp == udp {
+				svc = other
+				return
+			}
+		}
+	})
+	return
+}
+
+func (s *SshServer) handleServiceRequest(host string, port uint32, udp bool, client *SshConnection, builder ConnectionFactory) error {
+	svc := s.findService(host, port, udp)
+	if svc == nil {
+		return fmt.Errorf("No service %s on port %s", host, portString(port, udp))
+	}
+
+	if !client.isAdmin() && !svc.Allows(client.User()) {
+		svc.stats.rejected.Add(1)
+		return fmt.Errorf("Device %s not allowed on service %s", client.User(), svc.Name)
+	}
+
+	conn, err := builder()
+	if err != nil {
+		return err
+	}
+
+	svc.stats.connections.Add(1)
+	svc.stats.active.Add(1)
+	go func() {
+		defer svc.stats.active.Add(-1)
+		svc.Handler(client, &serviceConn{conn, svc.stats})
+	}()
+	return nil
+}
+
+// serviceConn counts the bytes exchanged with a service.
+type serviceConn struct {
+	net.Conn
+	stats *serviceCounters
+}
+
+func (c *serviceConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *serviceConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *serviceConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// discoveryService lists, one per line, the services a device can use.
+func (s *SshServer) discoveryService(client *SshConnection, conn net.Conn) {
+	defer conn.Close()
+	for _, svc := range s.Services() {
+		if !client.isAdmin() && !allowsDevice(svc.Devices, client.User()) {
+			continue
+		}
+		fmt.Fprintf(conn, "%s\t%s\t%s\n", svc.Name, portString(svc.Port, svc.Udp), svc.Description)
+	}
+}
+
+// DaytimeService sends the time of the brain, in RFC 3339 format, so devices
+// without NTP access can set their clock.
+func DaytimeService(client *SshConnection, conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "%s\n", time.Now().UTC().Format(time.RFC3339))
+}
+
+// servicesCommand lists the services, adds one with
+// `services add <http-proxy|udp-relay> <spec> [devices=<glob>[,<glob>...]]`
+// or removes one with `services rm <name>`.
+func servicesCommand(ctx CmdContext, args Arguments) int {
+	if len(args) > 0 && args[0] != "list" {
+		return changeServices(ctx, args)
+	}
+
+	fmt.Fprint(ctx, "Name\tPort\tDevices\tActive\tTotal\tRejected\tIn\tOut\tDescription\n")
+	for _, svc := range ctx.Server.Services() {
+		devices := "*"
+		if len(svc.Devices) > 0 {
+			devices = strings.Join(svc.Devices, ",")
+		}
+		fmt.Fprintf(ctx, "%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n", svc.Name, portString(svc.Port, svc.Udp), devices,
+			svc.Stats.Active, svc.Stats.Connections, svc.Stats.Rejected, svc.Stats.BytesIn, svc.Stats.BytesOut, svc.Description)
+	}
+	return 0
+}
+
+func changeServices(ctx CmdContext, args Arguments) int {
+	if args[0] != "add" && args[0] != "rm" {
+		return ctx.Usage("Unknown command %s", args[0])
+	} else if !ctx.Server.HasRole(ctx.Identity, ServicesRole) {
+		fmt.Fprintf(ctx.Stderr(), "%s %s: Permission denied\n", ctx.name, args[0])
+		return 126
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 3 && len(args) != 4 {
+			return ctx.Usage("Expected add <http-proxy|udp-relay> <spec> [devices=<glob>[,<glob>...]]")
+		}
+		spec := ServiceSpec{Kind: args[1], Spec: args[2]}
+		if len(args) == 4 {
+			if !strings.HasPrefix(args[3], "devices=") || args[3] == "devices=" {
+				return ctx.Usage("Expected devices=<glob>[,<glob>...]")
+			}
+			spec.Devices = strings.Split(strings.TrimPrefix(args[3], "devices="), ",")
+		}
+		if err := ctx.Server.AddService(spec); err != nil {
+			fmt.Fprintf(ctx.Stderr(), "Error adding service: %s\n", err)
+			return 1
+		}
+		ctx.Log.Printf("Service %s %s for devices %v added by %s\n", args[1], args[2], spec.Devices, ctx.Identity)
+	case "rm":
+		if len(args) != 2 {
+			return ctx.Usage("Missing name")
+		}
+		if err := ctx.Server.UnregisterService(args[1]); err != nil {
+			fmt.Fprintf(ctx.Stderr(), "%s\n", err)
+			return 1
+		}
+		ctx.Log.Printf("Service %s removed by %s\n", args[1], ctx.Identity)
+	}
+	return 0
+}
+
+// portString formats a port like `1812/udp`, TCP ports are left bare.
+func portString(port uint32, udp bool) string {
+	if udp {
+		return fmt.Sprintf("%d/udp", port)
+	}
+	return fmt.Sprint(port)
+}
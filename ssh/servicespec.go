@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/fsutil"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ServiceSpec describes a service configured without recompiling the brain,
+// with a command line flag or `services add`.
+type ServiceSpec struct {
+	// http-proxy, with Spec as `name:port=upstream[,allowed-url-prefix...]`,
+	// or udp-relay, with Spec as `name:port=host:port`
+	Kind string
+	Spec string
+	// Devices restricts the service like Service.Devices.
+	Devices []string `json:",omitempty"`
+}
+
+// ParseServiceSpec makes the service described by spec.
+func ParseServiceSpec(spec ServiceSpec) (svc Service, err error) {
+	switch spec.Kind {
+	case "http-proxy":
+		svc, err = parseHttpProxy(spec.Spec)
+	case "udp-relay":
+		svc, err = parseUdpRelay(spec.Spec)
+	default:
+		return Service{}, fmt.Errorf("Unknown service kind %s", spec.Kind)
+	}
+	if err != nil {
+		return Service{}, err
+	}
+	for _, pattern := range spec.Devices {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return Service{}, fmt.Errorf("Invalid device pattern %q", pattern)
+		}
+	}
+	svc.Devices = spec.Devices
+	return svc, nil
+}
+
+// parseHttpProxy parses `name:port=upstream[,allowed-url-prefix...]`.
+func parseHttpProxy(spec string) (Service, error) {
+	name, port, value, err := splitServiceSpec(spec)
+	if err != nil {
+		return Service{}, err
+	}
+	urls := strings.Split(value, ",")
+	upstream, err := url.Parse(urls[0])
+	if err != nil {
+		return Service{}, err
+	}
+
+	return Service{
+		Name:        name,
+		Description: "HTTP proxy to " + upstream.String(),
+		Port:        port,
+		Handler:     NewHttpProxy(upstream, urls[1:]).Handle,
+	}, nil
+}
+
+// parseUdpRelay parses `name:port=host:port`.
+func parseUdpRelay(spec string) (Service, error) {
+	name, port, upstream, err := splitServiceSpec(spec)
+	if err != nil {
+		return Service{}, err
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return Service{}, err
+	}
+
+	return Service{
+		Name:        name,
+		Description: "UDP relay to " + upstream,
+		Port:        port,
+		Udp:         true,
+		Handler:     UdpRelay(upstream),
+	}, nil
+}
+
+// splitServiceSpec splits `name:port=value`.
+func splitServiceSpec(spec string) (name string, port uint32, value string, err error) {
+	eq := strings.IndexByte(spec, '=')
+	colon := strings.IndexByte(spec, ':')
+	if eq == -1 || colon == -1 || colon > eq {
+		return "", 0, "", fmt.Errorf("Expected name:port=...")
+	}
+
+	p, err := strconv.ParseUint(spec[colon+1:eq], 10, 32)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("Invalid port %s", spec[colon+1:eq])
+	}
+	return spec[:colon], uint32(p), spec[eq+1:], nil
+}
+
+// AddService registers the service described by spec, it's saved if
+// RestoreServices was called.
+func (s *SshServer) AddService(spec ServiceSpec) error {
+	svc, err := ParseServiceSpec(spec)
+	if err != nil {
+		return err
+	}
+	s.a.Run(func() {
+		if err = s.registerService(svc); err != nil {
+			return
+		}
+		s.serviceSpecs[svc.Name] = spec
+		if err = s.saveServices(); err != nil {
+			// it wouldn't be restored
+			delete(s.serviceSpecs, svc.Name)
+			delete(s.services, svc.Name)
+		}
+	})
+	return err
+}
+
+// RestoreServices adds the services saved in path and saves the following
+// changes to it.
+func (s *SshServer) RestoreServices(path string) error {
+	var saved []ServiceSpec
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return fmt.Errorf("Invalid services %s: %s", path, err)
+		}
+	}
+
+	for _, spec := range saved {
+		if err := s.AddService(spec); err != nil {
+			log.Printf("Error restoring %s service %s: %s\n", spec.Kind, spec.Spec, err)
+		}
+	}
+	s.a.Run(func() {
+		s.servicesPath = path
+	})
+	return nil
+}
+
+// saveServices must be called from the server actor.
+func (s *SshServer) saveServices() error {
+	if s.servicesPath == "" {
+		return nil
+	}
+	list := make([]ServiceSpec, 0, len(s.serviceSpecs))
+	for _, spec := range s.serviceSpecs {
+		list = append(list, spec)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return fsutil.WriteFileAtomic(s.servicesPath, data, 0600)
+}
@@ -1,30 +1,67 @@
 package ssh
 
 import (
+	"github.com/JeanSebTr/SshBrain/domain"
 	"golang.org/x/crypto/ssh"
 )
 
 type Session struct {
-	ssh *ssh.Session
+	ssh  *ssh.Session
+	node *Node
 }
 
-func (s Session) Shell() error {
+func (s Session) Shell() (domain.ExitStatus, error) {
 	if err := s.ssh.Shell(); err != nil {
-		return err
+		return domain.ExitStatus{}, err
 	}
-	return s.ssh.Wait()
+	return waitStatus(s.ssh.Wait())
 }
 
-func (s Session) Exec(cmd string) (int, error) {
-	if err := s.ssh.Run(cmd); err != nil {
-		return 126, err
-	}
-	if err := s.ssh.Wait(); err != nil {
-		//
-	}
-	return 0, nil
+func (s Session) Exec(cmd string) (domain.ExitStatus, error) {
+	return waitStatus(s.ssh.Run(cmd))
 }
 
 func (s Session) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
 	return s.ssh.SendRequest(name, wantReply, payload)
 }
+
+func (s Session) Close() error {
+	return s.ssh.Close()
+}
+
+func (s Session) forwardChannels(kind string, c *SshConnection) (release func()) {
+	return s.node.setForwardTarget(kind, s.ssh, c)
+}
+
+// waitStatus converts the result of ssh.Session.Wait to an ExitStatus. Only
+// errors not coming from the remote command itself are returned.
+func waitStatus(err error) (domain.ExitStatus, error) {
+	switch e := err.(type) {
+	case nil:
+		return domain.ExitStatus{}, nil
+	case *ssh.ExitError:
+		return domain.ExitStatus{
+			Code:    e.ExitStatus(),
+			Signal:  e.Signal(),
+			Message: e.Msg(),
+		}, nil
+	default:
+		return domain.ExitStatus{}, err
+	}
+}
+
+// sendExitStatus reports to the client how its command terminated.
+func sendExitStatus(channel ssh.Channel, status domain.ExitStatus) error {
+	var err error
+	if status.Signal != "" {
+		_, err = channel.SendRequest("exit-signal", false, ssh.Marshal(ExitSignalRequest{
+			Signal: status.Signal,
+			Error:  status.Message,
+		}))
+	} else {
+		_, err = channel.SendRequest("exit-status", false, ssh.Marshal(ExitStatusRequest{
+			Status: uint32(status.Code),
+		}))
+	}
+	return err
+}
@@ -0,0 +1,420 @@
+package ssh
+
+import (
+	"fmt"
+	"github.com/JeanSebTr/SshBrain/artifact"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sftpHandler serves an SFTP view of all the nodes where each top-level
+// directory is a device id, e.g. `/AABBCCDDEEFF/etc/config` is `/etc/config`
+// on device AABBCCDDEEFF. Requests are relayed to the sftp-server of each
+// device through its reverse connection.
+type sftpHandler struct {
+	m       sync.Mutex
+	conn    *SshConnection
+	clients map[string]*nodeSftpClient
+}
+
+// nodeSftpClient is an SFTP client opened on a connection of a device, which
+// is replaced when the device reconnects.
+type nodeSftpClient struct {
+	node   *Node
+	client *sftp.Client
+}
+
+func (s *SshConnection) serveSftp(channel ssh.Channel) error {
+	h := &sftpHandler{
+		conn:    s,
+		clients: make(map[string]*nodeSftpClient),
+	}
+	defer h.Close()
+
+	server := sftp.NewRequestServer(channel, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+	defer server.Close()
+
+	if err := server.Serve(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func (h *sftpHandler) Close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for id, c := range h.clients {
+		c.client.Close()
+		delete(h.clients, id)
+	}
+}
+
+// splitDevicePath returns the device id and the path on that device designated by p.
+func splitDevicePath(p string) (id string, nodePath string) {
+	p = path.Clean("/" + p)[1:]
+	if i := strings.IndexByte(p, '/'); i != -1 {
+		return p[:i], p[i:]
+	}
+	return p, "/"
+}
+
+func (h *sftpHandler) client(id string) (*sftp.Client, error) {
+	node := h.conn.server.getNode(id)
+
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if c, exists := h.clients[id]; exists {
+		if c.node == node {
+			return c.client, nil
+		}
+		// the device reconnected or is gone
+		c.client.Close()
+		delete(h.clients, id)
+	}
+	if node == nil {
+		return nil, os.ErrNotExist
+	}
+
+	channel, reqs, err := node.OpenChannel("session", nil)
+	if err != nil {
+		h.conn.log.Printf("Error creating session on node id %s: %s\n", id, err)
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	go io.Copy(ioutil.Discard, channel.Stderr())
+
+	if ok, err := channel.SendRequest("subsystem", true, ssh.Marshal(SubsystemRequest{"sftp"})); err != nil || !ok {
+		channel.Close()
+		if err == nil {
+			err = fmt.Errorf("SFTP subsystem refused by node id %s", id)
+		}
+		h.conn.log.Println(err)
+		return nil, err
+	}
+
+	client, err := sftp.NewClientPipe(channel, channel)
+	if err != nil {
+		channel.Close()
+		h.conn.log.Printf("Error starting SFTP client on node id %s: %s\n", id, err)
+		return nil, err
+	}
+
+	h.conn.log.Printf("SFTP session opened on node id %s\n", id)
+	c := &nodeSftpClient{node, client}
+	h.clients[id] = c
+	go h.forgetOnClose(id, c)
+	return client, nil
+}
+
+// forgetOnClose removes c from the clients once its connection fails, so the
+// next request opens a new one.
+func (h *sftpHandler) forgetOnClose(id string, c *nodeSftpClient) {
+	err := c.client.Wait()
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.clients[id] == c {
+		h.conn.log.Printf("SFTP session closed on node id %s: %s\n", id, err)
+		delete(h.clients, id)
+	}
+}
+
+// nodeClient returns the client and path on the device for a request path,
+// refusing the virtual top-level directories.
+func (h *sftpHandler) nodeClient(p string) (*sftp.Client, string, error) {
+	id, nodePath := splitDevicePath(p)
+	if id == "" {
+		return nil, "", sftp.ErrSSHFxPermissionDenied
+	}
+	client, err := h.client(id)
+	return client, nodePath, err
+}
+
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	if id, p := splitDevicePath(r.Filepath); id == ArtifactsDir {
+		store, err := h.artifacts()
+		if err != nil {
+			return nil, err
+		}
+		file, _, err := store.Open(path.Base(p))
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+		return file, nil
+	}
+
+	client, p, err := h.nodeClient(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(p)
+}
+
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if id, p := splitDevicePath(r.Filepath); id == ArtifactsDir {
+		store, err := h.artifacts()
+		if err != nil {
+			return nil, err
+		}
+		if p == "/" || !artifact.ValidName(p[1:]) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+		file, err := store.TempFile()
+		if err != nil {
+			return nil, err
+		}
+		return &artifactUpload{file, store, p[1:], h.conn.KeyFingerprint(), h.conn}, nil
+	}
+
+	client, p, err := h.nodeClient(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	pflags := r.Pflags()
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return client.OpenFile(p, flags)
+}
+
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if id, p := splitDevicePath(r.Filepath); id == ArtifactsDir {
+		store, err := h.artifacts()
+		if err != nil {
+			return err
+		}
+		switch r.Method {
+		case "Setstat":
+			return nil
+		case "Remove":
+			if err := store.Delete(path.Base(p)); err != nil {
+				return os.ErrNotExist
+			}
+			h.conn.log.Printf("Artifact %s deleted by %s\n", path.Base(p), h.conn.KeyFingerprint())
+			return nil
+		}
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	client, p, err := h.nodeClient(r.Filepath)
+	if err != nil {
+		return err
+	}
+	if p == "/" && r.Method != "Setstat" {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(client, p, r)
+	case "Rename":
+		targetId, target := splitDevicePath(r.Target)
+		if id, _ := splitDevicePath(r.Filepath); id != targetId {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		return client.Rename(p, target)
+	case "Rmdir":
+		return client.RemoveDirectory(p)
+	case "Remove":
+		return client.Remove(p)
+	case "Mkdir":
+		return client.Mkdir(p)
+	case "Link":
+		targetId, target := splitDevicePath(r.Target)
+		if id, _ := splitDevicePath(r.Filepath); id != targetId {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		return client.Link(p, target)
+	case "Symlink":
+		// r.Filepath is the target of the link, r.Target is the link itself
+		linkClient, link, err := h.nodeClient(r.Target)
+		if err != nil {
+			return err
+		}
+		return linkClient.Symlink(p, link)
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandler) setstat(client *sftp.Client, p string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.Size {
+		if err := client.Truncate(p, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := client.Chmod(p, attrs.FileMode()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := client.Chown(p, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := client.Chtimes(p, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	id, p := splitDevicePath(r.Filepath)
+	if id == "" {
+		switch r.Method {
+		case "List":
+			return h.listDevices(), nil
+		case "Stat":
+			return listerAt{virtualDir("/")}, nil
+		}
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+
+	if id == ArtifactsDir {
+		return h.listArtifacts(r.Method, p)
+	}
+
+	client, err := h.client(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Method {
+	case "List":
+		files, err := client.ReadDir(p)
+		return listerAt(files), err
+	case "Stat":
+		if p == "/" {
+			return listerAt{virtualDir(id)}, nil
+		}
+		file, err := client.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{file}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Readlink returns the target of a link on a device, absolute targets are
+// made relative to the directory of the device.
+func (h *sftpHandler) Readlink(p string) (string, error) {
+	id, p := splitDevicePath(p)
+	if id == "" || id == ArtifactsDir {
+		return "", sftp.ErrSSHFxOpUnsupported
+	}
+
+	client, err := h.client(id)
+	if err != nil {
+		return "", err
+	}
+	target, err := client.ReadLink(p)
+	if err != nil {
+		return "", err
+	}
+	if path.IsAbs(target) {
+		target = path.Join("/", id, target)
+	}
+	return target, nil
+}
+
+func (h *sftpHandler) listDevices() listerAt {
+	nodes := h.conn.server.GetAll()
+	files := make(listerAt, 0, len(nodes)+1)
+	for _, node := range nodes {
+		files = append(files, virtualDir(strings.ToUpper(node.Id())))
+	}
+	if h.conn.server.artifacts != nil {
+		files = append(files, virtualDir(ArtifactsDir))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files
+}
+
+func (h *sftpHandler) artifacts() (*artifact.Store, error) {
+	if h.conn.server.artifacts == nil {
+		return nil, os.ErrNotExist
+	}
+	return h.conn.server.artifacts, nil
+}
+
+func (h *sftpHandler) listArtifacts(method string, p string) (sftp.ListerAt, error) {
+	store, err := h.artifacts()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case method == "Stat" && p == "/":
+		return listerAt{virtualDir(ArtifactsDir)}, nil
+	case method == "Stat":
+		if a, exists := store.Get(path.Base(p)); exists {
+			return listerAt{artifactInfo{a}}, nil
+		}
+		return nil, os.ErrNotExist
+	case method == "List" && p == "/":
+		list := store.List()
+		files := make(listerAt, len(list))
+		for i, a := range list {
+			files[i] = artifactInfo{a}
+		}
+		return files, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// virtualDir is a directory of the SFTP view which doesn't exist on a device.
+type virtualDir string
+
+func (d virtualDir) Name() string       { return string(d) }
+func (d virtualDir) Size() int64        { return 0 }
+func (d virtualDir) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (d virtualDir) ModTime() time.Time { return time.Time{} }
+func (d virtualDir) IsDir() bool        { return true }
+func (d virtualDir) Sys() interface{}   { return nil }
@@ -2,27 +2,50 @@ package ssh
 
 import (
 	"golang.org/x/crypto/ssh"
+	"io"
 	"log"
 	"net"
+	"os"
+	"sync"
 	"time"
 )
 
+// TcpChannel is a net.Conn over an SSH channel. Data is read from the channel
+// by a goroutine so reads and writes can be cancelled by their deadline.
 type TcpChannel struct {
 	ssh.Channel
 	reqs  <-chan *ssh.Request
 	log   *log.Logger
 	rAddr net.Addr
 	lAddr net.Addr
+
+	rm            sync.Mutex
+	chunks        chan []byte
+	pending       []byte
+	readErr       error // set before chunks is closed
+	readDeadline  deadline
+	wm            sync.Mutex
+	writing       chan struct{} // closed when the write in progress is done
+	writeErr      error         // set before writing is closed
+	writeDeadline deadline
+	closeOnce     sync.Once
+	closed        chan struct{}
 }
 
 func NewTcpChannel(rAddr, lAddr net.Addr, c ssh.Channel, reqs <-chan *ssh.Request, l *log.Logger) *TcpChannel {
-	return &TcpChannel{
-		Channel: c,
-		reqs:    reqs,
-		log:     l,
-		rAddr:   rAddr,
-		lAddr:   lAddr,
+	conn := &TcpChannel{
+		Channel:       c,
+		reqs:          reqs,
+		log:           l,
+		rAddr:         rAddr,
+		lAddr:         lAddr,
+		chunks:        make(chan []byte),
+		readDeadline:  makeDeadline(),
+		writeDeadline: makeDeadline(),
+		closed:        make(chan struct{}),
 	}
+	go conn.readLoop()
+	return conn
 }
 
 func (c *TcpChannel) LocalAddr() net.Addr {
@@ -42,17 +65,209 @@ func (c *TcpChannel) logAndRejectRequests() {
 	}
 }
 
+// readLoop hands the data of the channel to Read, one chunk at a time so the
+// SSH window still limits what the other side can send.
+func (c *TcpChannel) readLoop() {
+	defer close(c.chunks)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := c.Channel.Read(buf)
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.closed:
+				c.readErr = net.ErrClosed
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *TcpChannel) Read(b []byte) (int, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	if isClosedChan(c.closed) {
+		return 0, net.ErrClosed
+	} else if isClosedChan(c.readDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	if len(c.pending) == 0 && len(b) > 0 {
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = chunk
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write sends b on the channel. When the write deadline expires first, the
+// write carries on in the background and the next writes wait for it: b is
+// then counted as written along with os.ErrDeadlineExceeded.
+func (c *TcpChannel) Write(b []byte) (int, error) {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	expired := c.writeDeadline.wait()
+	if err := c.waitWrite(expired); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	done := make(chan struct{})
+	var n int
+	c.writing = done
+	go func() {
+		var err error
+		if n, err = c.Channel.Write(buf); err != nil {
+			c.writeErr = err
+		}
+		close(done)
+	}()
+
+	err := c.waitWrite(expired)
+	if c.writing == nil {
+		return n, err
+	} else if err == os.ErrDeadlineExceeded {
+		// the data can't be taken back from the channel
+		return len(b), err
+	}
+	return 0, err
+}
+
+// waitWrite waits for the write in progress, if any. It must be called with
+// wm held.
+func (c *TcpChannel) waitWrite(expired chan struct{}) error {
+	if isClosedChan(c.closed) {
+		return net.ErrClosed
+	} else if isClosedChan(expired) {
+		return os.ErrDeadlineExceeded
+	}
+
+	if c.writing != nil {
+		select {
+		case <-c.writing:
+			c.writing = nil
+		case <-expired:
+			return os.ErrDeadlineExceeded
+		case <-c.closed:
+			return net.ErrClosed
+		}
+	}
+	return c.writeErr
+}
+
+// CloseWrite sends EOF once the pending writes are done.
+func (c *TcpChannel) CloseWrite() error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	if err := c.waitWrite(nil); err != nil {
+		return err
+	}
+	return c.Channel.CloseWrite()
+}
+
+// Close closes the channel, closing it again returns net.ErrClosed like Read
+// and Write. The other side having closed it first isn't an error.
+func (c *TcpChannel) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if err = c.Channel.Close(); err == io.EOF {
+			err = nil
+		}
+	})
+	return err
+}
+
 func (c *TcpChannel) SetDeadline(t time.Time) error {
-	c.log.Println("TcpChannel.SetDeadline not implemented", t)
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 	return nil
 }
 
 func (c *TcpChannel) SetReadDeadline(t time.Time) error {
-	c.log.Println("TcpChannel.SetReadDeadline not implemented", t)
+	c.readDeadline.set(t)
 	return nil
 }
 
 func (c *TcpChannel) SetWriteDeadline(t time.Time) error {
-	c.log.Println("TcpChannel.SetWriteDeadline not implemented", t)
+	c.writeDeadline.set(t)
 	return nil
 }
+
+// deadline is a channel closed when a time is reached, like the one of
+// net.Pipe.
+type deadline struct {
+	m      sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{cancel: make(chan struct{})}
+}
+
+// set changes the deadline, the zero time meaning none.
+func (d *deadline) set(t time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+	} else if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline is reached.
+func (d *deadline) wait() chan struct{} {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,113 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/nettest"
+)
+
+func TestTcpChannelConn(t *testing.T) {
+	nettest.TestConn(t, makeTcpChannelPipe)
+}
+
+// makeTcpChannelPipe connects two TcpChannels through an SSH connection over
+// a local TCP connection.
+func makeTcpChannelPipe() (c1, c2 net.Conn, stop func(), err error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	clientConfig := &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+
+	// net.Pipe would deadlock, both sides send their version first
+	l, err := nettest.NewLocalListener("tcp")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer l.Close()
+	p1, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	p2, err := l.Accept()
+	if err != nil {
+		p1.Close()
+		return nil, nil, nil, err
+	}
+	type server struct {
+		conn  *ssh.ServerConn
+		chans <-chan ssh.NewChannel
+		err   error
+	}
+	servers := make(chan server, 1)
+	go func() {
+		conn, chans, reqs, err := ssh.NewServerConn(p2, serverConfig)
+		if err == nil {
+			go ssh.DiscardRequests(reqs)
+		}
+		servers <- server{conn, chans, err}
+	}()
+
+	clientConn, clientChans, clientReqs, err := ssh.NewClientConn(p1, "pipe", clientConfig)
+	if err != nil {
+		p1.Close()
+		p2.Close()
+		return nil, nil, nil, err
+	}
+	go ssh.DiscardRequests(clientReqs)
+	go func() {
+		for newChan := range clientChans {
+			newChan.Reject(ssh.Prohibited, "")
+		}
+	}()
+	srv := <-servers
+	if srv.err != nil {
+		clientConn.Close()
+		return nil, nil, nil, srv.err
+	}
+
+	accepted := make(chan *TcpChannel, 1)
+	go func() {
+		newChan := <-srv.chans
+		channel, reqs, err := newChan.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- NewTcpChannel(p1.RemoteAddr(), p2.LocalAddr(), channel, reqs, log.New(io.Discard, "", 0))
+	}()
+
+	channel, reqs, err := clientConn.OpenChannel("direct-tcpip", nil)
+	if err != nil {
+		clientConn.Close()
+		srv.conn.Close()
+		return nil, nil, nil, err
+	}
+	c1 = NewTcpChannel(p2.LocalAddr(), p1.RemoteAddr(), channel, reqs, log.New(io.Discard, "", 0))
+	other := <-accepted
+	if other == nil {
+		clientConn.Close()
+		srv.conn.Close()
+		return nil, nil, nil, io.ErrUnexpectedEOF
+	}
+	c2 = other
+	stop = func() {
+		c1.Close()
+		c2.Close()
+		clientConn.Close()
+		srv.conn.Close()
+	}
+	return c1, c2, stop, nil
+}
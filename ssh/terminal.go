@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/JeanSebTr/SshBrain/domain"
 	"golang.org/x/crypto/ssh"
@@ -9,60 +10,321 @@ import (
 	"log"
 	"os"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
+const shellPrompt = "root@brain > "
+
+// keyCtrlR starts a reverse search in the history, keyCtrlG cancels it.
+const (
+	keyCtrlG = 7
+	keyCtrlR = 18
+)
+
+// keyErase is what backspace is read as, from the private use area, so the
+// terminal passes it to autoCompleteCallback instead of handling it itself.
+const keyErase = '\uf8ff'
+
+var eraseReplacer = strings.NewReplacer("\x7f", string(keyErase), "\b", string(keyErase))
+
+// eraseReader reads backspace as keyErase. The control keys which the
+// terminal handles itself, like the arrows or Enter, are read apart from the
+// keys before them and beforeControl is called before they are.
+type eraseReader struct {
+	io.ReadWriter
+	pending       []byte
+	beforeControl func()
+}
+
+func (r *eraseReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		n, err := r.ReadWriter.Read(b)
+		if n == 0 {
+			return 0, err
+		}
+		r.pending = []byte(eraseReplacer.Replace(string(b[:n])))
+	}
+
+	pending := r.pending
+	if i := indexControl(pending); i > 0 {
+		pending = pending[:i]
+	} else if i == 0 {
+		if r.beforeControl != nil {
+			r.beforeControl()
+		}
+		if next := indexControl(pending[1:]); next != -1 {
+			pending = pending[:1+next]
+		}
+	}
+	n := copy(b, pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// indexControl returns the index of the first control key in b which isn't
+// passed to autoCompleteCallback, or -1.
+func indexControl(b []byte) int {
+	for i, c := range b {
+		if c < ' ' && c != keyCtrlR && c != keyCtrlG && c != '\t' {
+			return i
+		}
+	}
+	return -1
+}
+
 type TerminalSession struct {
 	ssh.Channel
-	server  *SshServer
-	reqs    <-chan *ssh.Request
-	term    *terminal.Terminal
-	ptyInfo *domain.PtyRequest
+	server *SshServer
+	conn   *SshConnection
+	reqs   *sessionRequests
+	term   *terminal.Terminal
+	input  *sessionInput
+	// lastTab is set when the previous key was a tab which didn't complete
+	lastTab bool
+	// history of the admin, including the lines of this session
+	history []string
+	search  *historySearch
+	// held while a command runs
+	notifications heldNotifications
 }
 
-func NewTerminal(server *SshServer, channel ssh.Channel, reqs <-chan *ssh.Request) *TerminalSession {
+// historySearch is the state of a Ctrl-R reverse search.
+type historySearch struct {
+	query    string
+	index    int // of the current match in history
+	original string
+}
+
+func NewTerminal(conn *SshConnection, channel ssh.Channel, reqs *sessionRequests) *TerminalSession {
 	t := &TerminalSession{
 		Channel: channel,
-		server:  server,
+		server:  conn.server,
+		conn:    conn,
 		reqs:    reqs,
+		input:   newSessionInput(channel),
 	}
-	t.term = terminal.NewTerminal(t.Channel, "root@brain > ")
+	t.loadHistory()
 
 	t.term.AutoCompleteCallback = t.autoCompleteCallback
 
-	go func() {
-		for req := range reqs {
-			t.ptyInfo = &domain.PtyRequest{}
-			ssh.Unmarshal(req.Payload, t.ptyInfo)
-			t.term.SetSize(int(t.ptyInfo.CharWidth), int(t.ptyInfo.CharHeight))
-		}
-	}()
+	reqs.OnResize(func(width, height int) {
+		t.term.SetSize(width, height)
+	})
 
 	return t
 }
 
+// loadHistory creates the terminal with the saved history of the admin, so
+// it can be recalled with the arrow keys.
+func (t *TerminalSession) loadHistory() {
+	if t.server.history != nil {
+		var err error
+		if t.history, err = t.server.history.Load(t.conn.KeyFingerprint()); err != nil {
+			t.conn.log.Printf("Error loading history: %s\n", err)
+		}
+	}
+
+	var replayed []string
+	for _, line := range t.history {
+		if replayable(line) {
+			replayed = append(replayed, line)
+		}
+	}
+	if len(replayed) > 100 { // size of the terminal history
+		replayed = replayed[len(replayed)-100:]
+	}
+
+	input := &eraseReader{ReadWriter: inputChannel{t.Channel, t.input}, beforeControl: func() {
+		if t.search != nil {
+			// like readline, the arrows move from the matched line
+			t.endSearch()
+		}
+	}}
+	c := &seededChannel{ReadWriter: input, muted: true}
+	for _, line := range replayed {
+		c.seed = append(c.seed, line+"\r"...)
+	}
+	t.term = terminal.NewTerminal(c, shellPrompt)
+	for range replayed {
+		if _, err := t.term.ReadLine(); err != nil {
+			break
+		}
+	}
+	c.muted = false
+}
+
 func (t *TerminalSession) Start() {
+	defer t.showNotifications()()
 	for {
 		line, err := t.term.ReadLine()
+		if t.search != nil {
+			t.endSearch()
+		}
 		if err == io.EOF {
 			t.Channel.Close()
 			return
 		} else if err != nil {
 			log.Printf("Error reading cmd %s\r\n", err)
-			fmt.Fprintf(t.term, "Error reading cmd %s\r\n", err)
+			fmt.Fprintf(t.term, "Error reading cmd %s\n", err)
 		} else if strings.Trim(line, " \t") != "" {
-			commands.Exec(CmdContext{
-				Channel: t.Channel,
-				Log:     log.New(os.Stderr, "Terminal", log.LstdFlags|log.Lshortfile),
-				Manager: t.server,
-				Pty:     t.ptyInfo,
+			t.addHistory(line)
+			release := t.notifications.hold(t.term)
+			t.server.commands().Exec(CmdContext{
+				Channel:  terminalChannel{inputChannel{t.Channel, t.input}, t.term},
+				Log:      log.New(os.Stderr, "Terminal", log.LstdFlags|log.Lshortfile),
+				Server:   t.server,
+				Identity: t.conn.KeyFingerprint(),
+				Pty:      t.reqs.Pty(),
+				reqs:     t.reqs,
 			}, line)
+			release()
+		}
+	}
+}
+
+func (t *TerminalSession) addHistory(line string) {
+	t.history = append(t.history, line)
+	if t.server.history != nil {
+		if err := t.server.history.Add(t.conn.KeyFingerprint(), line); err != nil {
+			t.conn.log.Printf("Error saving history: %s\n", err)
 		}
 	}
 }
 
+// autoCompleteCallback is called by the terminal, without its lock held, for
+// the keys it doesn't handle itself.
 func (t *TerminalSession) autoCompleteCallback(line string, pos int, key rune) (string, int, bool) {
-	if key == 9 {
-		//
+	if key == keyCtrlR || t.search != nil {
+		if newLine, newPos, handled := t.reverseSearch(line, pos, key); handled {
+			return newLine, newPos, true
+		}
+	}
+	if key == '\t' {
+		return t.complete(line, pos)
+	}
+	t.lastTab = false
+	if key == keyErase {
+		_, size := utf8.DecodeLastRuneInString(line[:pos])
+		return line[:pos-size] + line[pos:], pos - size, true
 	}
 	return line, pos, false
 }
+
+// reverseSearch handles the keys typed during a Ctrl-R search: printable keys
+// refine the query and backspace shortens it, Ctrl-R goes to the previous
+// match and Ctrl-G restores the line. Other keys, including the special keys
+// of the terminal, end the search and keep the matched line.
+func (t *TerminalSession) reverseSearch(line string, pos int, key rune) (string, int, bool) {
+	if t.search == nil {
+		t.search = &historySearch{index: len(t.history), original: line}
+	}
+	search := t.search
+
+	from := search.index
+	switch {
+	case key == keyCtrlR:
+		from--
+	case key == keyCtrlG:
+		t.endSearch()
+		return search.original, len(search.original), true
+	case key == keyErase:
+		// the shorter query matches again from the latest line
+		_, size := utf8.DecodeLastRuneInString(search.query)
+		search.query = search.query[:len(search.query)-size]
+		search.index = len(t.history)
+		from = search.index
+	case unicode.IsPrint(key) && key < 0xd800:
+		// above are the special keys of the terminal and keyErase
+		search.query += string(key)
+	default:
+		t.endSearch()
+		return line, pos, false
+	}
+
+	newLine, newPos := line, pos
+	prompt := "(failed reverse-i-search)`%s': "
+	for i := from; i >= 0 && search.query != ""; i-- {
+		if i >= len(t.history) {
+			continue
+		}
+		if at := strings.Index(t.history[i], search.query); at != -1 {
+			search.index = i
+			newLine, newPos = t.history[i], at
+			prompt = "(reverse-i-search)`%s': "
+			break
+		}
+	}
+	if search.query == "" {
+		prompt = "(reverse-i-search)`%s': "
+	}
+	t.term.SetPrompt(fmt.Sprintf(prompt, search.query))
+	t.term.Write(nil) // redraws the prompt
+	return newLine, newPos, true
+}
+
+func (t *TerminalSession) endSearch() {
+	t.search = nil
+	t.term.SetPrompt(shellPrompt)
+	t.term.Write(nil)
+}
+
+// terminalChannel routes the output of commands run in the brain shell through
+// the terminal, so it is ordered with what the terminal writes and has its
+// line endings translated once. Commands relaying byte streams use
+// CmdContext.Raw instead.
+type terminalChannel struct {
+	inputChannel
+	term *terminal.Terminal
+}
+
+func (c terminalChannel) Write(b []byte) (int, error) {
+	// the terminal translates \n to \r\n itself
+	if _, err := c.term.Write(bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c terminalChannel) Stderr() io.ReadWriter {
+	return stderrChannel{c}
+}
+
+// isTerminal tells if c is the terminal of the admin, in the brain shell or
+// with `ssh -t`.
+func isTerminal(c domain.Channel) bool {
+	switch c.(type) {
+	case terminalChannel, ptyChannel:
+		return true
+	}
+	return false
+}
+
+// ptyChannel is the channel of a command run with a pty outside the brain
+// shell, e.g. `ssh -t root@brain devices`. Nothing translates line endings
+// for the terminal of the admin, so it does. Without a pty commands write
+// plain \n.
+type ptyChannel struct {
+	inputChannel
+}
+
+func (c ptyChannel) Write(b []byte) (int, error) {
+	return crlfWriter{c.inputChannel}.Write(b)
+}
+
+func (c ptyChannel) Stderr() io.ReadWriter {
+	return stderrChannel{crlfWriter{c.inputChannel.Stderr()}}
+}
+
+// crlfWriter writes \n as \r\n.
+type crlfWriter struct {
+	io.Writer
+}
+
+func (w crlfWriter) Write(b []byte) (int, error) {
+	lf := bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+	if _, err := w.Writer.Write(bytes.Replace(lf, []byte("\n"), []byte("\r\n"), -1)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
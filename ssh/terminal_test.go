@@ -0,0 +1,62 @@
+package ssh
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writerChannel is a session channel only written to.
+type writerChannel struct {
+	ssh.Channel
+	w io.Writer
+}
+
+func (c writerChannel) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+func TestReverseSearch(t *testing.T) {
+	tests := []struct {
+		keys string
+		line string
+	}{
+		{"\x12foo\r", "foo 2"},
+		{"\x12foo\x12\r", "foo 1"},
+		{"\x12foo\x12\x12\r", "foo 1"},
+		{"\x12fox\x7f\x7f\r", "foo 2"},
+		{"\x12foo 1\x7f\x7f2\r", "foo 2"},
+		{"cd\x12foo\x07\r", "cd"},
+		// other keys end the search on the match
+		{"\x12foo\x1b[Cx\r", "fxoo 2"},
+		{"\x12foo\x1b[15~!\r", "!foo 2"},
+		{"\x12ls\x1b[A\r", "foo 2"},
+		{"\x12été\r", "été"},
+	}
+	for _, test := range tests {
+		r, w := io.Pipe()
+		session := &TerminalSession{
+			Channel: writerChannel{w: ioutil.Discard},
+			server:  &SshServer{},
+			input:   newSessionInput(r),
+			history: []string{"ls a", "foo 1", "été", "bar", "foo 2"},
+		}
+		session.loadHistory()
+		session.term.AutoCompleteCallback = session.autoCompleteCallback
+		go io.WriteString(w, test.keys)
+
+		line, err := session.term.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != test.line {
+			t.Errorf("%q read %q, want %q", test.keys, line, test.line)
+		}
+		if session.search != nil {
+			t.Errorf("%q is still searching", test.keys)
+		}
+		w.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DevicesDomain is the pseudo domain under which nodes can be reached through
+// the brain, e.g. `AABBCCDDEEFF.devices`.
+const DevicesDomain = ".devices"
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// splice copies data both ways between a and b until both sides are done
+// writing, then closes them.
+func splice(a, b io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go pipe(&wg, a, b)
+	go pipe(&wg, b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+func pipe(wg *sync.WaitGroup, dst io.WriteCloser, src io.Reader) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// deviceIdFromHost extracts the node id from a host name in DevicesDomain.
+// Other host names are returned unchanged with ok set to false.
+func deviceIdFromHost(host string) (id string, ok bool) {
+	if len(host) > len(DevicesDomain) && strings.EqualFold(host[len(host)-len(DevicesDomain):], DevicesDomain) {
+		return host[:len(host)-len(DevicesDomain)], true
+	}
+	return host, false
+}
+
+// proxyChannel relays data and requests between two channels. Requests coming
+// back from b, like exit-status, are forwarded before a is closed.
+func proxyChannel(a ssh.Channel, aReqs <-chan *ssh.Request, b ssh.Channel, bReqs <-chan *ssh.Request) {
+	go func() {
+		forwardRequests(b, aReqs)
+		b.Close()
+	}()
+	go func() {
+		io.Copy(b, a)
+		b.CloseWrite()
+	}()
+
+	reqsDone := make(chan struct{})
+	go func() {
+		forwardRequests(a, bReqs)
+		close(reqsDone)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(a, b)
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(a.Stderr(), b.Stderr())
+		wg.Done()
+	}()
+	wg.Wait()
+	a.CloseWrite()
+
+	<-reqsDone
+	a.Close()
+}
+
+func forwardRequests(dst ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		ok, err := dst.SendRequest(req.Type, req.WantReply, req.Payload)
+		if err != nil {
+			ok = false
+		}
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package ssh
+
+import "testing"
+
+func TestDeviceIdFromHost(t *testing.T) {
+	tests := []struct {
+		host string
+		id   string
+		ok   bool
+	}{
+		{"AABBCCDDEEFF.devices", "AABBCCDDEEFF", true},
+		{"aabbccddeeff.DEVICES", "aabbccddeeff", true},
+		{"a.b.devices", "a.b", true},
+		{".devices", ".devices", false},
+		{"devices", "devices", false},
+		{"example.com", "example.com", false},
+		{"AABBCCDDEEFF.devices.example.com", "AABBCCDDEEFF.devices.example.com", false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		id, ok := deviceIdFromHost(test.host)
+		if id != test.id || ok != test.ok {
+			t.Errorf("deviceIdFromHost(%q) = %q, %t, want %q, %t", test.host, id, ok, test.id, test.ok)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// UdpChannelType carries UDP datagrams in both directions: devices open it to
+// reach UDP services of the brain, admins to reach a device port, and the
+// brain to reach a device port. Its extra data is the same as direct-tcpip
+// and each datagram is prefixed by its length as a big endian uint16.
+const UdpChannelType = "udp@sshbrain"
+
+// MaxDatagramSize is the largest datagram a UDP channel can carry.
+const MaxDatagramSize = 65535
+
+// UdpIdleTimeout closes UDP relays which haven't carried a datagram for that
+// long, since UDP has no end of connection.
+var UdpIdleTimeout = 2 * time.Minute
+
+// UdpChannel is a connected datagram conn over a channel, each Read returns a
+// single datagram and each Write sends one.
+type UdpChannel struct {
+	*TcpChannel
+	rm sync.Mutex
+	r  *bufio.Reader
+}
+
+func NewUdpChannel(c *TcpChannel) *UdpChannel {
+	return &UdpChannel{
+		TcpChannel: c,
+		r:          bufio.NewReaderSize(c, 2+MaxDatagramSize),
+	}
+}
+
+// Read reads the next datagram. Like with UDP sockets, what doesn't fit in b
+// is discarded. A datagram is only consumed once complete so a deadline
+// doesn't break the framing.
+func (c *UdpChannel) Read(b []byte) (int, error) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+
+	header, err := c.r.Peek(2)
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	frame, err := c.r.Peek(2 + size)
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	n := copy(b, frame[2:])
+	c.r.Discard(2 + size)
+	return n, nil
+}
+
+// Write sends b as a single frame, TcpChannel writes it whole even when the
+// deadline expires.
+func (c *UdpChannel) Write(b []byte) (int, error) {
+	if len(b) > MaxDatagramSize {
+		return 0, fmt.Errorf("Datagram of %d bytes is too large", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	if _, err := c.TcpChannel.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// relayDatagrams copies datagrams both ways between a and b, then closes
+// them when either side fails or after UdpIdleTimeout without traffic.
+func relayDatagrams(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	idle := time.AfterFunc(UdpIdleTimeout, closeBoth)
+	defer idle.Stop()
+
+	copyDatagrams := func(dst, src net.Conn) {
+		defer closeBoth()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				return
+			}
+			idle.Reset(UdpIdleTimeout)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyDatagrams(a, b)
+	}()
+	go func() {
+		defer wg.Done()
+		copyDatagrams(b, a)
+	}()
+	wg.Wait()
+}
+
+// UdpRelay returns a service handler relaying the datagrams of devices to an
+// upstream UDP server, e.g. a RADIUS server at `radius.example.com:1812`.
+func UdpRelay(upstream string) ServiceCallback {
+	return func(client *SshConnection, conn net.Conn) {
+		remote, err := net.Dial("udp", upstream)
+		if err != nil {
+			client.log.Printf("Error dialing UDP upstream %s: %s\n", upstream, err)
+			conn.Close()
+			return
+		}
+		client.log.Printf("Relaying UDP to %s\n", upstream)
+		relayDatagrams(conn, remote)
+		client.log.Printf("UDP relay to %s closed\n", upstream)
+	}
+}
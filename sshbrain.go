@@ -2,16 +2,26 @@ package main
 
 import (
 	"flag"
+	"github.com/JeanSebTr/SshBrain/artifact"
+	"github.com/JeanSebTr/SshBrain/inventory"
+	"github.com/JeanSebTr/SshBrain/logstore"
 	"github.com/JeanSebTr/SshBrain/ssh"
 	"io"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 var (
 	httpAddress string
 	sshAddress  string
 	serverKey   string
+	stateDir    string
+	rolesFile   string
+	httpProxies stringList
+	udpRelays   stringList
 	admins      = []string{
 		// zap_rsa (jstremblay)
 		"ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC4roEPEt5d+GFJU7znMZJNaAB+iLOeiCwmN20YTwxBxCE8PcoxQXkeyx1HE64wsIzCrHXUz3cFUeqUP6ChmMe5KQ+NyOGKMHgmIGXjKUtP4w/dPEmu/h9IaOOTu7s8BWxltSYA8BdM+tswyheT8qrClPgp8QG+zBhgmUy3+l30CooCO6OlvYHs9z2KnnjWEgm2RA/SjZT/C/62z1eti549nFoV2qCBKeAASFV/WWOYg4OUKzvm2DVrNjNqfXNADBydPoxcdTIYbG/TybnnokcyCUrK61Wk6XjKZuixW0q7h52DoOpuw6ksDVbUG7GgnrMypENDZ0P/GWb+Dei2wDFL",
@@ -22,6 +32,11 @@ func init() {
 	flag.StringVar(&serverKey, "key", "", "SSH key to use for the server")
 	flag.StringVar(&httpAddress, "http", "0.0.0.0:80", "TCP address for the Web server to listen")
 	flag.StringVar(&sshAddress, "ssh", "0.0.0.0:22", "TCP address for the SSH server to listen")
+	flag.StringVar(&stateDir, "state", "", "Directory where the brain keeps artifacts, device logs, the inventory, history, exposed ports and added services, none are kept when empty")
+	flag.StringVar(&rolesFile, "roles", "", "File granting roles to admin keys, one `role authorized-key` per line")
+	flag.Var(&httpProxies, "http-proxy", "HTTP proxy service for devices, as `name:port=upstream[,allowed-url-prefix...]` (repeatable)")
+	flag.Var(&udpRelays, "udp-relay", "UDP service relaying devices to a server, as `name:port=host:port` (repeatable)")
+	flag.Int64Var(&ssh.MaxScpFileSize, "max-file-size", ssh.MaxScpFileSize, "Largest file transferred with scp, in bytes")
 }
 
 func main() {
@@ -30,15 +45,118 @@ func main() {
 	log.Println("Addresses", httpAddress, sshAddress)
 
 	server := ssh.NewServer(serverKey, admins)
+	if rolesFile != "" {
+		if err := server.LoadRoles(rolesFile); err != nil {
+			log.Fatalf("Error loading roles: %s\n", err)
+		}
+	}
+
+	var logs *logstore.Store
+	var configs *inventory.Store
+	if stateDir == "" {
+		log.Println("No -state directory, artifacts, device logs, inventory, history, exposed ports and added services are not kept")
+	} else {
+		if err := os.MkdirAll(stateDir, 0700); err != nil {
+			log.Fatalf("Error creating the -state directory: %s\n", err)
+		}
+
+		store, err := artifact.NewStore(filepath.Join(stateDir, "artifacts"))
+		if err != nil {
+			log.Fatalf("Error opening artifact store: %s\n", err)
+		}
+		server.SetArtifactStore(store)
+
+		if logs, err = logstore.NewStore(filepath.Join(stateDir, "logs"), 1<<20, 5); err != nil {
+			log.Fatalf("Error opening log store: %s\n", err)
+		}
+		server.SetLogStore(logs)
+
+		if configs, err = inventory.NewStore(filepath.Join(stateDir, "config")); err != nil {
+			log.Fatalf("Error opening inventory: %s\n", err)
+		}
+		server.SetInventory(configs)
+
+		if err := server.SetHistoryDir(filepath.Join(stateDir, "history")); err != nil {
+			log.Fatalf("Error opening history: %s\n", err)
+		}
+
+		if err := server.RestoreExposures(filepath.Join(stateDir, "exposures.json")); err != nil {
+			log.Fatalf("Error restoring exposed ports: %s\n", err)
+		}
+	}
 
-	server.ExposeService(7, func(client *ssh.SshConnection, conn net.Conn) {
-		log.Printf("[%s] Connection to echo service from %s\n", client.RemoteAddr(), conn.RemoteAddr().String())
-		if _, err := io.Copy(conn, conn); err != nil {
-			log.Printf("[%s] Error on echo service connection: %s\n", client.RemoteAddr(), err)
-		} else {
-			log.Printf("[%s] Connection to echo service closed.\n", client.RemoteAddr())
+	services := []ssh.Service{
+		{
+			Name:        "echo",
+			Description: "Echo back everything received",
+			Port:        7,
+			Handler: func(client *ssh.SshConnection, conn net.Conn) {
+				log.Printf("[%s] Connection to echo service from %s\n", client.RemoteAddr(), conn.RemoteAddr().String())
+				if _, err := io.Copy(conn, conn); err != nil {
+					log.Printf("[%s] Error on echo service connection: %s\n", client.RemoteAddr(), err)
+				} else {
+					log.Printf("[%s] Connection to echo service closed.\n", client.RemoteAddr())
+				}
+			},
+		},
+		{
+			Name:        "daytime",
+			Description: "Current time of the brain in RFC 3339 format",
+			Port:        13,
+			Handler:     ssh.DaytimeService,
+		},
+	}
+	if logs != nil {
+		services = append(services, ssh.Service{
+			Name:        "syslog",
+			Description: "Syslog (RFC 5424 or 3164) over TCP, shown by the logs command",
+			Port:        514,
+			Handler:     ssh.SyslogService(logs),
+		})
+	}
+	if configs != nil {
+		services = append(services, ssh.Service{
+			Name:        "config",
+			Description: "HTTP server of the device configuration rendered from the inventory",
+			Port:        81,
+			Handler:     ssh.ConfigService(configs),
+		})
+	}
+	for _, spec := range httpProxies {
+		svc, err := ssh.ParseServiceSpec(ssh.ServiceSpec{Kind: "http-proxy", Spec: spec})
+		if err != nil {
+			log.Fatalf("Invalid -http-proxy %s: %s\n", spec, err)
+		}
+		services = append(services, svc)
+	}
+	for _, spec := range udpRelays {
+		svc, err := ssh.ParseServiceSpec(ssh.ServiceSpec{Kind: "udp-relay", Spec: spec})
+		if err != nil {
+			log.Fatalf("Invalid -udp-relay %s: %s\n", spec, err)
+		}
+		services = append(services, svc)
+	}
+	for _, svc := range services {
+		if err := server.RegisterService(svc); err != nil {
+			log.Fatalf("Error registering service %s: %s\n", svc.Name, err)
 		}
-	})
+	}
+	if stateDir != "" {
+		if err := server.RestoreServices(filepath.Join(stateDir, "services.json")); err != nil {
+			log.Fatalf("Error restoring services: %s\n", err)
+		}
+	}
 
 	server.Listen(sshAddress)
 }
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}